@@ -0,0 +1,499 @@
+// Package azal searches flights with the azal.az booking API.
+//
+// Search sends a single search and returns the API's response:
+//
+//	data, err := azal.Search(ctx, azal.QueryConfig{From: "NAJ", To: "BAK", DepartureDate: "2024-09-24"}, azal.HeaderConfig{})
+//	if errors.Is(err, azal.ErrorNoFlightsAvailable) {
+//		...
+//	}
+//
+// NewRequest, ReadBody and ParseResponse are the steps of Search, for callers
+// that need to wrap the request (rate limiting, metrics, logging the raw body).
+package azal
+
+import (
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RequestURL is the flight search endpoint.
+	RequestURL = "https://azal.az/book/api/flights/search/by-deeplink"
+	// BookingURL is the azal.az page that opens a search from the same query parameters the API takes.
+	BookingURL = "https://azal.az/book/flights/search/by-deeplink"
+	// DefaultUserAgent is the User-Agent HeaderConfig.SetDefaults fills in.
+	DefaultUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0"
+)
+
+var (
+	ErrorNoFlightsAvailable = fmt.Errorf("no flights available")
+	ErrorFlowInterrupted    = fmt.Errorf("flow interrupted")
+	// A StatusCodeError matches one of these with errors.Is, by its status code.
+	ErrorRateLimited = fmt.Errorf("rate limited")
+	ErrorServerError = fmt.Errorf("server error")
+	ErrorBadStatus   = fmt.Errorf("bad status")
+	// ErrorUnknown is wrapped by the error responses with a code not listed above.
+	ErrorUnknown = fmt.Errorf("unknown error")
+)
+
+// Timezone is used to read the departure and arrival times of the responses.
+// The API returns them in the local time of the airport without an offset,
+// so for Azal's airports this is Asia/Baku.
+var Timezone = time.FixedZone("Asia/Baku", 4*60*60)
+
+type StatusCodeError struct {
+	StatusCode int
+	// RetryAfter is the wait the server asked for with a Retry-After header, if any.
+	RetryAfter time.Duration
+	// Body is the body of the response, which often explains the status.
+	Body []byte
+}
+
+func (statusCodeError *StatusCodeError) Error() string {
+	return fmt.Sprintf("status code: %d", statusCodeError.StatusCode)
+}
+
+func (statusCodeError *StatusCodeError) Unwrap() error {
+	switch {
+	case statusCodeError.StatusCode == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case statusCodeError.StatusCode >= 500:
+		return ErrorServerError
+	default:
+		return ErrorBadStatus
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+type Price struct {
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+func (price Price) String() string {
+	return strconv.FormatFloat(price.Amount, 'f', -1, 64) + " " + price.Currency
+}
+
+type ResponseTime struct {
+	time.Time
+	// Local is set when the time came without an offset, as a wall clock
+	// that is only assumed to be in Timezone.
+	Local bool
+}
+
+// ResponseTimeLayouts are the layouts ResponseTime accepts, tried in order.
+// Times without an offset are in Timezone. Both accept fractional seconds,
+// which time.Parse allows after a seconds field.
+var ResponseTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+// UnmarshalJSON leaves the time zero for null or an empty string. Times with an
+// offset or Z are converted to Timezone.
+func (responseTime *ResponseTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("time should be a string: %s", b)
+	}
+	if s == "" {
+		return nil
+	}
+
+	for i, layout := range ResponseTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, Timezone); err == nil {
+			responseTime.Time, responseTime.Local = t.In(Timezone), i == 0
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported time format: %q", s)
+}
+
+type ResponseOption struct {
+	ID                         string `json:"id"`
+	Available                  bool   `json:"available"`
+	CheapestEconomySolutionId  string `json:"cheapestEconomySolutionId"`
+	CheapestBusinessSolutionId string `json:"cheapestBusinessSolutionId"`
+	// AvailableSeats is the number of seats left; 0 when the API doesn't tell.
+	AvailableSeats int `json:"availableSeats"`
+	Route          struct {
+		ID            string       `json:"id"`
+		DepartureDate ResponseTime `json:"departureDate"`
+		ArrivalDate   ResponseTime `json:"arrivalDate"`
+	} `json:"route"`
+}
+
+// ResponseWarning is an informational message the API attaches to a search,
+// e.g. about a schedule change. Flights may still be available.
+type ResponseWarning struct {
+	Code string `json:"code"`
+	Text string `json:"text"`
+}
+
+func (w *ResponseWarning) UnmarshalJSON(b []byte) error {
+	// Some warnings are sent as plain strings.
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		w.Text = text
+		return nil
+	}
+	type warning ResponseWarning
+	return json.Unmarshal(b, (*warning)(w))
+}
+
+func (w ResponseWarning) String() string {
+	if w.Code == "" {
+		return w.Text
+	}
+	if w.Text == "" {
+		return w.Code
+	}
+	return w.Code + ": " + w.Text
+}
+
+type SuccessResponse struct {
+	Warnings []ResponseWarning `json:"warnings"`
+	Search   struct {
+		OptionSets []struct {
+			Options []ResponseOption `json:"options"`
+		} `json:"optionSets"`
+		// Solutions hold the fares the options' cheapest*SolutionId fields point to.
+		Solutions []ResponseSolution `json:"solutions"`
+	} `json:"search"`
+}
+
+// ResponseSolution is a fare: the price of a fare family for the options in OptionIDs.
+type ResponseSolution struct {
+	ID    string `json:"id"`
+	Price Price  `json:"price"`
+	// FareFamily is the name of the fare, like Light, Standard or Flex; empty when the API doesn't tell.
+	FareFamily string `json:"fareFamily"`
+	// OptionIDs are the options the fare is offered for.
+	OptionIDs []string `json:"optionIds"`
+}
+
+// SolutionPrice returns the fare of the solution with the given id, or nil if there is none.
+func (successResponse *SuccessResponse) SolutionPrice(id string) *Price {
+	if id == "" {
+		return nil
+	}
+	for _, solution := range successResponse.Search.Solutions {
+		if solution.ID == id {
+			price := solution.Price
+			return &price
+		}
+	}
+	return nil
+}
+
+// OptionSolutions returns every fare offered for the option, cheapest first: the
+// solutions listing it in OptionIDs and its cheapest economy and business ones.
+func (successResponse *SuccessResponse) OptionSolutions(option ResponseOption) []ResponseSolution {
+	var solutions []ResponseSolution
+	for _, solution := range successResponse.Search.Solutions {
+		if solution.ID == option.CheapestEconomySolutionId || solution.ID == option.CheapestBusinessSolutionId ||
+			(option.ID != "" && slices.Contains(solution.OptionIDs, option.ID)) {
+			solutions = append(solutions, solution)
+		}
+	}
+	slices.SortStableFunc(solutions, func(a, b ResponseSolution) int { return cmp.Compare(a.Price.Amount, b.Price.Amount) })
+	return solutions
+}
+
+type ErrorResponse struct {
+	Error struct {
+		Code string `json:"code"`
+		Text string `json:"text"`
+	} `json:"error"`
+}
+
+type HeaderConfig struct {
+	Host           string `req_header:"Host"`
+	UserAgent      string `req_header:"User-Agent"`
+	Accept         string `req_header:"Accept"`
+	AcceptLanguage string `req_header:"Accept-Language"`
+	AcceptEncoding string `req_header:"Accept-Encoding"`
+	XApplication   string `req_header:"x-application"`
+	XLocale        string `req_header:"x-locale"`
+	Connection     string `req_header:"Connection"`
+	Referer        string `req_header:"Referer"`
+	SecFetchDest   string `req_header:"Sec-Fetch-Dest"`
+	SecFetchMode   string `req_header:"Sec-Fetch-Mode"`
+	SecFetchSite   string `req_header:"Sec-Fetch-Site"`
+	TE             string `req_header:"TE"`
+	// Authorization is optional, for an API or gateway that requires credentials.
+	Authorization string `req_header:"Authorization"`
+}
+
+// SetDefaults fills in the empty fields with the headers of a browser on azal.az.
+func (headerConf *HeaderConfig) SetDefaults() {
+	if headerConf.Host == "" {
+		headerConf.Host = "book.azal.az"
+	}
+	if headerConf.UserAgent == "" {
+		headerConf.UserAgent = DefaultUserAgent
+	}
+	if headerConf.Accept == "" {
+		headerConf.Accept = "application/json, text/plain, */*"
+	}
+	if headerConf.AcceptLanguage == "" {
+		headerConf.AcceptLanguage = "en-US,en;q=0.5"
+	}
+	if headerConf.AcceptEncoding == "" {
+		// br is not advertised because the standard library can't decode brotli.
+		headerConf.AcceptEncoding = "gzip, deflate"
+	}
+	if headerConf.XApplication == "" {
+		headerConf.XApplication = "ibe"
+	}
+	if headerConf.XLocale == "" {
+		headerConf.XLocale = "az"
+	}
+	if headerConf.Connection == "" {
+		headerConf.Connection = "keep-alive"
+	}
+	if headerConf.SecFetchDest == "" {
+		headerConf.SecFetchDest = "empty"
+	}
+	if headerConf.SecFetchMode == "" {
+		headerConf.SecFetchMode = "cors"
+	}
+	if headerConf.SecFetchSite == "" {
+		headerConf.SecFetchSite = "same-origin"
+	}
+	if headerConf.TE == "" {
+		headerConf.TE = "trailers"
+	}
+}
+
+// SetToRequest sets every field to the header named by its req_header tag.
+// Empty fields are left out instead of being sent as empty headers, so optional
+// headers like Authorization only appear when they are set.
+func (headerConf *HeaderConfig) SetToRequest(req *http.Request) {
+	t := reflect.TypeOf(*headerConf)
+	v := reflect.ValueOf(headerConf).Elem()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("req_header")
+		value := v.Field(i).String()
+		if value == "" {
+			continue
+		}
+		req.Header.Set(tag, value)
+	}
+}
+
+type QueryConfig struct {
+	Lang          string `req_query:"lang"`
+	From          string `req_query:"from"`
+	To            string `req_query:"to"`
+	DepartureDate string `req_query:"departure_date"`
+	ReturnDate    string `req_query:"return_date"`
+	TripType      string `req_query:"tripType"`
+	AdultCount    string `req_query:"adult_count"`
+	ChildCount    string `req_query:"child_count"`
+	// InfantCount is the number of infants on an adult's lap.
+	InfantCount string `req_query:"infant_count"`
+	// InfantWithSeatCount is the number of infants with their own seat; left out when empty.
+	InfantWithSeatCount string `req_query:"infant_with_seat_count"`
+	IsStudent           string `req_query:"is_student"`
+	Timestamp           string `req_query:"timestamp"`
+	IsCitizen           string `req_query:"is_citizen"`
+	Currency            string `req_query:"currency"`
+	Theme               string `req_query:"theme"`
+}
+
+// SetDefaults fills in the empty fields: a one way trip for one adult, in AZN.
+func (queryConf *QueryConfig) SetDefaults() {
+	if queryConf.Lang == "" {
+		queryConf.Lang = "az"
+	}
+	if queryConf.TripType == "" {
+		queryConf.TripType = "OW"
+	}
+	if queryConf.AdultCount == "" {
+		queryConf.AdultCount = "1"
+	}
+	if queryConf.ChildCount == "" {
+		queryConf.ChildCount = "0"
+	}
+	if queryConf.InfantCount == "" {
+		queryConf.InfantCount = "0"
+	}
+	if queryConf.IsStudent == "" {
+		queryConf.IsStudent = "0"
+	}
+	if queryConf.Timestamp == "" {
+		queryConf.Timestamp = fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond))
+	}
+	if queryConf.IsCitizen == "" {
+		queryConf.IsCitizen = "1"
+	}
+	if queryConf.Currency == "" {
+		queryConf.Currency = "AZN"
+	}
+	if queryConf.Theme == "" {
+		queryConf.Theme = "dark"
+	}
+}
+
+// SetToRequest adds every non-empty field to the query as the parameter named by its req_query tag.
+func (queryConf *QueryConfig) SetToRequest(req *http.Request) {
+	q := req.URL.Query()
+	t := reflect.TypeOf(*queryConf)
+	v := reflect.ValueOf(queryConf).Elem()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("req_query")
+		value := v.Field(i).String()
+		if value == "" {
+			continue
+		}
+		q.Add(tag, value)
+	}
+
+	req.URL.RawQuery = q.Encode()
+}
+
+func handleErrorResponse(errorResponse *ErrorResponse) error {
+	switch errorResponse.Error.Code {
+	case "no.flights.available":
+		return ErrorNoFlightsAvailable
+	case "flow.interrupted.error":
+		return ErrorFlowInterrupted
+	default:
+		return fmt.Errorf("%w: %s", ErrorUnknown, errorResponse.Error.Code)
+	}
+}
+
+// NewRequest builds the search request for apiURL from the configs, as they are.
+func NewRequest(ctx context.Context, apiURL string, queryConf *QueryConfig, headerConf *HeaderConfig) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	headerConf.SetToRequest(req)
+	queryConf.SetToRequest(req)
+	return req, nil
+}
+
+// ReadBody reads the response body and decodes it by its Content-Encoding.
+// Setting Accept-Encoding by hand turns off the transparent gzip decoding of
+// net/http, so the body has to be decoded here.
+func ReadBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var reader io.ReadCloser
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate should be zlib wrapped, but some servers send a raw deflate stream.
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, fmt.Errorf("error: unsupported response Content-Encoding: %s", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error: decoding %s response: %v", resp.Header.Get("Content-Encoding"), err)
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error: decoding %s response: %v", resp.Header.Get("Content-Encoding"), err)
+	}
+	return decoded, nil
+}
+
+// ParseResponse turns the response and its body read by ReadBody into the search results.
+// A status other than 200 is a *StatusCodeError and an error in the body one of the
+// Error* values. A body without the optionSets has no flights and isn't an error,
+// so a change of the API's schema doesn't stop the caller.
+func ParseResponse(resp *http.Response, body []byte) (*SuccessResponse, error) {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &StatusCodeError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")), Body: body}
+	}
+	if resp.StatusCode != 200 {
+		return nil, &StatusCodeError{StatusCode: resp.StatusCode, Body: body}
+	}
+	var data struct {
+		ErrorResponse
+		SuccessResponse
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, fmt.Errorf("error: parsing response: %v", err)
+	}
+	if data.Error.Code != "" {
+		return nil, handleErrorResponse(&data.ErrorResponse)
+	}
+	return &data.SuccessResponse, nil
+}
+
+// Client sends the searches with HTTPClient to URL.
+type Client struct {
+	HTTPClient *http.Client
+	URL        string
+}
+
+// DefaultClient is used by Search.
+var DefaultClient = &Client{HTTPClient: http.DefaultClient, URL: RequestURL}
+
+// Search sends a single flight search. The fields left empty in the configs get their defaults.
+func (client *Client) Search(ctx context.Context, queryConf QueryConfig, headerConf HeaderConfig) (*SuccessResponse, error) {
+	queryConf.SetDefaults()
+	headerConf.SetDefaults()
+	req, err := NewRequest(ctx, client.URL, &queryConf, &headerConf)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ReadBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	return ParseResponse(resp, body)
+}
+
+// Search sends a single flight search with DefaultClient.
+func Search(ctx context.Context, queryConf QueryConfig, headerConf HeaderConfig) (*SuccessResponse, error) {
+	return DefaultClient.Search(ctx, queryConf, headerConf)
+}
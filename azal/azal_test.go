@@ -0,0 +1,174 @@
+package azal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newResponse(statusCode int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{StatusCode: statusCode, Header: header, Body: io.NopCloser(bytes.NewReader(body))}
+}
+
+func TestReadBody(t *testing.T) {
+	body := []byte(`{"search":{"optionSets":[]}}`)
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write(body)
+	w.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"plain", "", body},
+		{"identity", "identity", body},
+		{"gzip", "gzip", compressed.Bytes()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := make(http.Header)
+			if test.encoding != "" {
+				header.Set("Content-Encoding", test.encoding)
+			}
+			got, err := ReadBody(newResponse(http.StatusOK, header, test.body))
+			if err != nil {
+				t.Fatalf("ReadBody: %v", err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("ReadBody = %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		header     http.Header
+		body       string
+		// want is matched with errors.Is, nil means success.
+		want           error
+		wantStatusCode int
+		wantParseError bool
+	}{
+		{name: "success", statusCode: http.StatusOK, body: `{"search":{"optionSets":[{"options":[]}]}}`},
+		{name: "rate limited", statusCode: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"7"}}, body: "slow down", want: ErrorRateLimited, wantStatusCode: http.StatusTooManyRequests},
+		{name: "server error", statusCode: http.StatusServiceUnavailable, body: "maintenance", want: ErrorServerError, wantStatusCode: http.StatusServiceUnavailable},
+		{name: "bad status", statusCode: http.StatusBadRequest, body: `{"error":"bad request"}`, want: ErrorBadStatus, wantStatusCode: http.StatusBadRequest},
+		{name: "empty body", statusCode: http.StatusOK, body: "", wantParseError: true},
+		{name: "malformed json", statusCode: http.StatusOK, body: `{"search":`, wantParseError: true},
+		{name: "no flights", statusCode: http.StatusOK, body: `{"error":{"code":"no.flights.available"}}`, want: ErrorNoFlightsAvailable},
+		{name: "flow interrupted", statusCode: http.StatusOK, body: `{"error":{"code":"flow.interrupted.error"}}`, want: ErrorFlowInterrupted},
+		{name: "unknown code", statusCode: http.StatusOK, body: `{"error":{"code":"invalid.airport"}}`, want: ErrorUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := ParseResponse(newResponse(test.statusCode, test.header, []byte(test.body)), []byte(test.body))
+			switch {
+			case test.wantParseError:
+				if err == nil || !strings.Contains(err.Error(), "parsing response") {
+					t.Fatalf("err = %v, want a parsing error", err)
+				}
+			case test.want == nil:
+				if err != nil || data == nil {
+					t.Fatalf("ParseResponse = %v, %v, want a response", data, err)
+				}
+			case !errors.Is(err, test.want):
+				t.Fatalf("err = %v, want %v", err, test.want)
+			}
+			if test.wantStatusCode == 0 {
+				return
+			}
+			var statusCodeError *StatusCodeError
+			if !errors.As(err, &statusCodeError) {
+				t.Fatalf("err = %T, want *StatusCodeError", err)
+			}
+			if statusCodeError.StatusCode != test.wantStatusCode || string(statusCodeError.Body) != test.body {
+				t.Errorf("StatusCodeError = %d %q, want %d %q", statusCodeError.StatusCode, statusCodeError.Body, test.wantStatusCode, test.body)
+			}
+		})
+	}
+}
+
+func TestParseResponseRetryAfter(t *testing.T) {
+	_, err := ParseResponse(newResponse(http.StatusTooManyRequests, http.Header{"Retry-After": {"7"}}, nil), nil)
+	var statusCodeError *StatusCodeError
+	if !errors.As(err, &statusCodeError) || statusCodeError.RetryAfter != 7*time.Second {
+		t.Errorf("err = %v, want a StatusCodeError with RetryAfter 7s", err)
+	}
+}
+
+func TestHeaderConfigSetToRequest(t *testing.T) {
+	req, err := http.NewRequest("GET", RequestURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerConf := HeaderConfig{UserAgent: "test-agent", Authorization: "Bearer token"}
+	headerConf.SetToRequest(req)
+
+	for name, want := range map[string]string{"User-Agent": "test-agent", "Authorization": "Bearer token"} {
+		if got := req.Header.Values(name); len(got) != 1 || got[0] != want {
+			t.Errorf("header %s = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"Host", "Accept", "Accept-Language", "Accept-Encoding", "x-application", "Referer", "TE"} {
+		if _, ok := req.Header[http.CanonicalHeaderKey(name)]; ok {
+			t.Errorf("header %s is set for an empty field", name)
+		}
+	}
+	if len(req.Header) != 2 {
+		t.Errorf("headers = %v, want only the two non-empty fields", req.Header)
+	}
+}
+
+func TestResponseTimeUnmarshalJSON(t *testing.T) {
+	want := time.Date(2030, 1, 2, 8, 30, 0, 0, Timezone)
+	tests := []struct {
+		name string
+		json string
+		want time.Time
+	}{
+		{"local", `"2030-01-02T08:30:00"`, want},
+		{"local with milliseconds", `"2030-01-02T08:30:00.250"`, want.Add(250 * time.Millisecond)},
+		{"offset", `"2030-01-02T06:30:00+02:00"`, want},
+		{"utc", `"2030-01-02T04:30:00Z"`, want},
+		{"utc with nanoseconds", `"2030-01-02T04:30:00.000000001Z"`, want.Add(time.Nanosecond)},
+		{"null", `null`, time.Time{}},
+		{"empty", `""`, time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var responseTime ResponseTime
+			if err := responseTime.UnmarshalJSON([]byte(test.json)); err != nil {
+				t.Fatalf("UnmarshalJSON(%s): %v", test.json, err)
+			}
+			if !responseTime.Equal(test.want) {
+				t.Errorf("UnmarshalJSON(%s) = %s, want %s", test.json, responseTime.Time, test.want)
+			}
+			if !test.want.IsZero() && responseTime.Location() != Timezone {
+				t.Errorf("UnmarshalJSON(%s) location = %s, want %s", test.json, responseTime.Location(), Timezone)
+			}
+			if wantLocal := strings.HasPrefix(test.name, "local"); responseTime.Local != wantLocal {
+				t.Errorf("UnmarshalJSON(%s) Local = %t, want %t", test.json, responseTime.Local, wantLocal)
+			}
+		})
+	}
+
+	for _, value := range []string{`"02.01.2030 08:30"`, `"2030-01-02"`, `1893561000`} {
+		var responseTime ResponseTime
+		if err := responseTime.UnmarshalJSON([]byte(value)); err == nil {
+			t.Errorf("UnmarshalJSON(%s) = %s, want an error", value, responseTime.Time)
+		}
+	}
+}
@@ -1,29 +1,383 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/aykhans/azal-bot/azal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
 	"io"
 	"log"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	_ "time/tzdata"
 )
 
 const (
-	RequestURL     = "https://azal.az/book/api/flights/search/by-deeplink"
-	TelegramAPIURL = "https://api.telegram.org/bot%s/sendMessage"
-	Version        = "0.2.1"
+	// TelegramAPIURL is the default of the hidden --telegram-api-url flag.
+	TelegramAPIURL = "https://api.telegram.org"
+	PushoverAPIURL = "https://api.pushover.net/1/messages.json"
+	// FXAPIURL is the default of --fx-url; {currency} is replaced by the search currency.
+	FXAPIURL = "https://open.er-api.com/v6/latest/{currency}"
+	Version  = "0.2.1"
+	// DefaultInstanceName is the default of --instance-name.
+	DefaultInstanceName = "Azal Bot"
+
+	// LatencySamples is the number of request latencies kept for the latency statistics.
+	LatencySamples = 1000
+	// MinRepetInterval keeps the bot from hammering the API.
+	MinRepetInterval = 10 * time.Second
+	// MaxPassengers is the largest party that can be searched at once.
+	MaxPassengers = 9
+	// MaxConcurrency caps the parallel requests so the bot doesn't trip the API's rate limiting.
+	MaxConcurrency = 8
+	// HealthFailureThreshold is the number of consecutive failed requests after which /healthz reports 503.
+	HealthFailureThreshold = 5
+	// ErrorNotifyThreshold is the number of consecutive failed requests that triggers an error notification.
+	ErrorNotifyThreshold = 3
+	// ErrorNotifyInterval is the minimum time between two error notifications.
+	ErrorNotifyInterval = 30 * time.Minute
+	// RetryBaseDelay is the delay before the first retry; it doubles on each next one.
+	RetryBaseDelay = time.Second
+	// RateLimitDelay is the pause after a 429 response without a Retry-After header.
+	RateLimitDelay = 30 * time.Second
+	// MaxRateLimitDelay caps the pause a Retry-After header can ask for.
+	MaxRateLimitDelay = 5 * time.Minute
+	// TelegramMaxRetries is how many times a message rate limited by Telegram is sent again.
+	TelegramMaxRetries = 3
+	// TelegramMaxRetryAfter is the longest retry_after that is waited for; a longer one fails the message.
+	TelegramMaxRetryAfter = time.Minute
+	// MaxIntervalFactor caps how much repeated 429 responses stretch the repetition interval.
+	MaxIntervalFactor = 8
+	// ShutdownTimeout is how long the bot may take to stop after SIGINT or SIGTERM before it is forced to exit.
+	ShutdownTimeout = 10 * time.Second
+)
+
+// Currencies are the fare currencies the API accepts.
+var Currencies = []string{"AZN", "USD", "EUR", "RUB", "TRY"}
+
+// Locales are the languages the API answers in, set with --locale.
+var Locales = []string{"az", "en", "ru"}
+
+// Backends are the notification backends --primary-backend and --fallback-backend can name.
+var Backends = []string{"telegram", "discord", "slack", "pushover", "ntfy", "matrix", "email", "sms", "webhook"}
+
+// CabinClasses are the values of --cabin-class.
+var CabinClasses = []string{"economy", "business"}
+
+// Exit codes of a single check (--once).
+const (
+	ExitCodeFlightsFound = 0
+	ExitCodeNoFlights    = 2
+	ExitCodeRequestError = 3
+	// ExitCodeNoMatch is returned with --exit-on-first-match when the deadline is reached before a flight was found.
+	ExitCodeNoMatch = 4
+	// ExitCodeUnrecoverable is returned with --fail-fast when a request fails in a way retrying can't fix.
+	ExitCodeUnrecoverable = 5
 )
 
 var (
-	ErrorNoFlightsAvailable = fmt.Errorf("no flights available")
-	ErrorFlowInterrupted    = fmt.Errorf("flow interrupted")
+	// ErrorCircuitOpen is returned instead of sending a request while the circuit breaker is open.
+	ErrorCircuitOpen = fmt.Errorf("circuit breaker open")
+	// ErrorBudgetExhausted is returned instead of sending a request once --max-requests were sent.
+	ErrorBudgetExhausted = fmt.Errorf("request budget exhausted")
 )
 
+var metrics = struct {
+	Requests          prometheus.Counter
+	RequestErrors     prometheus.Counter
+	NoFlights         prometheus.Counter
+	FlightsFound      prometheus.Counter
+	NotificationsSent prometheus.Counter
+	RequestDuration   prometheus.Histogram
+}{
+	Requests: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "azal_bot_requests_total",
+		Help: "Flight search requests sent to the API.",
+	}),
+	RequestErrors: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "azal_bot_request_errors_total",
+		Help: "Flight searches that failed after all retries.",
+	}),
+	NoFlights: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "azal_bot_no_flights_total",
+		Help: "Flight searches that returned no available flights.",
+	}),
+	FlightsFound: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "azal_bot_flights_found_total",
+		Help: "Available flights found.",
+	}),
+	NotificationsSent: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "azal_bot_notifications_sent_total",
+		Help: "Flight notifications sent.",
+	}),
+	RequestDuration: promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "azal_bot_request_duration_seconds",
+		Help:    "Latency of the flight search requests.",
+		Buckets: prometheus.DefBuckets,
+	}),
+}
+
+// Health is the state the /healthz endpoint reports.
+type Health struct {
+	mu                  sync.Mutex
+	lastSuccessfulPoll  time.Time
+	consecutiveFailures int
+}
+
+var health = &Health{}
+
+func (health *Health) recordRequest(ok bool) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if ok {
+		health.consecutiveFailures = 0
+	} else {
+		health.consecutiveFailures++
+	}
+}
+
+func (health *Health) recordSuccessfulPoll() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.lastSuccessfulPoll = time.Now()
+}
+
+func (health *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	health.mu.Lock()
+	status := "ok"
+	statusCode := http.StatusOK
+	if health.consecutiveFailures >= HealthFailureThreshold {
+		status = "failing"
+		statusCode = http.StatusServiceUnavailable
+	}
+	body := map[string]any{
+		"status":               status,
+		"consecutive_failures": health.consecutiveFailures,
+		"last_successful_poll": nil,
+	}
+	if !health.lastSuccessfulPoll.IsZero() {
+		body["last_successful_poll"] = health.lastSuccessfulPoll
+	}
+	health.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+// startServer serves mux on addr in the background.
+func startServer(name, addr string, mux *http.ServeMux) *http.Server {
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error(LogFields{Event: name + "_server_failed"}, "Error: ", name, " server: ", err.Error())
+		}
+	}()
+	return server
+}
+
+// RateLimit pauses all requests after the API answers 429 Too Many Requests.
+type RateLimit struct {
+	mu    sync.Mutex
+	until time.Time
+	// limited is set when a 429 was received since the last call of takeLimited.
+	limited bool
+}
+
+var rateLimit = &RateLimit{}
+
+// wait blocks until the pause asked for by the last 429 response is over,
+// or returns ctx.Err() if ctx is cancelled first.
+func (rateLimit *RateLimit) wait(ctx context.Context) error {
+	rateLimit.mu.Lock()
+	until := rateLimit.until
+	rateLimit.mu.Unlock()
+	if !sleepContext(ctx, min(time.Until(until), MaxRateLimitDelay)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// hit pauses the requests for retryAfter, RateLimitDelay if the server didn't
+// say, but never longer than MaxRateLimitDelay.
+func (rateLimit *RateLimit) hit(retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = RateLimitDelay
+	}
+	retryAfter = min(retryAfter, MaxRateLimitDelay)
+	rateLimit.mu.Lock()
+	defer rateLimit.mu.Unlock()
+	if until := time.Now().Add(retryAfter); until.After(rateLimit.until) {
+		rateLimit.until = until
+	}
+	rateLimit.limited = true
+}
+
+// takeLimited reports whether a 429 was received since the previous call.
+func (rateLimit *RateLimit) takeLimited() bool {
+	rateLimit.mu.Lock()
+	defer rateLimit.mu.Unlock()
+	limited := rateLimit.limited
+	rateLimit.limited = false
+	return limited
+}
+
+// TokenBucket spaces the requests to Rate per second on average, allowing bursts of up to Burst requests.
+// It is shared by all concurrent requests; a nil TokenBucket doesn't limit.
+type TokenBucket struct {
+	mu     sync.Mutex
+	Rate   float64
+	Burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *TokenBucket {
+	burst := max(1, math.Floor(rate))
+	return &TokenBucket{Rate: rate, Burst: burst, tokens: burst, last: time.Now()}
+}
+
+// requestLimiter limits the requests to the API, if --rate-limit is set.
+var requestLimiter *TokenBucket
+
+// wait takes a token, blocking until one is available. Requests wait in turn
+// instead of being dropped: the tokens can go negative, which reserves the
+// next ones for the requests that are already waiting. If ctx is cancelled
+// first, the token is given back and ctx.Err() is returned.
+func (tokenBucket *TokenBucket) wait(ctx context.Context) error {
+	if tokenBucket == nil {
+		return nil
+	}
+	tokenBucket.mu.Lock()
+	now := time.Now()
+	tokenBucket.tokens = min(tokenBucket.Burst, tokenBucket.tokens+now.Sub(tokenBucket.last).Seconds()*tokenBucket.Rate)
+	tokenBucket.last = now
+	tokenBucket.tokens--
+	var delay time.Duration
+	if tokenBucket.tokens < 0 {
+		delay = time.Duration(-tokenBucket.tokens / tokenBucket.Rate * float64(time.Second))
+	}
+	tokenBucket.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		tokenBucket.mu.Lock()
+		tokenBucket.tokens++
+		tokenBucket.mu.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// RequestBudget counts the requests to the API and refuses the ones over Max.
+// It is shared by all concurrent requests; a nil RequestBudget doesn't limit.
+type RequestBudget struct {
+	Max  int64
+	used atomic.Int64
+}
+
+// requestBudget stops the requests to the API after --max-requests, if set.
+var requestBudget *RequestBudget
+
+// take reserves a request and reports whether it is within the budget.
+func (requestBudget *RequestBudget) take() bool {
+	if requestBudget == nil {
+		return true
+	}
+	return requestBudget.used.Add(1) <= requestBudget.Max
+}
+
+func (requestBudget *RequestBudget) exhausted() bool {
+	return requestBudget != nil && requestBudget.used.Load() >= requestBudget.Max
+}
+
+// LatencyStats keeps the durations of the last LatencySamples API requests in a
+// ring buffer, so its memory stays constant however long the bot runs.
+type LatencyStats struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	// count is the number of requests recorded since the start.
+	count int
+}
+
+// latencyStats records the latency of every API request that got a response.
+var latencyStats = newLatencyStats(LatencySamples)
+
+func newLatencyStats(size int) *LatencyStats {
+	return &LatencyStats{samples: make([]time.Duration, 0, size)}
+}
+
+func (latencyStats *LatencyStats) record(latency time.Duration) {
+	latencyStats.mu.Lock()
+	defer latencyStats.mu.Unlock()
+	if len(latencyStats.samples) < cap(latencyStats.samples) {
+		latencyStats.samples = append(latencyStats.samples, latency)
+	} else {
+		latencyStats.samples[latencyStats.next] = latency
+		latencyStats.next = (latencyStats.next + 1) % len(latencyStats.samples)
+	}
+	latencyStats.count++
+}
+
+// String summarizes the samples as min/avg/p95/max, or returns "" when there are none.
+func (latencyStats *LatencyStats) String() string {
+	latencyStats.mu.Lock()
+	samples := slices.Clone(latencyStats.samples)
+	count := latencyStats.count
+	latencyStats.mu.Unlock()
+	if len(samples) == 0 {
+		return ""
+	}
+	slices.Sort(samples)
+	var total time.Duration
+	for _, sample := range samples {
+		total += sample
+	}
+	p95 := samples[(len(samples)*95+99)/100-1]
+	return fmt.Sprintf(
+		"min %s, avg %s, p95 %s, max %s over the last %d of %d request(s)",
+		samples[0].Round(time.Millisecond), (total / time.Duration(len(samples))).Round(time.Millisecond),
+		p95.Round(time.Millisecond), samples[len(samples)-1].Round(time.Millisecond), len(samples), count,
+	)
+}
+
 var Colors = struct {
 	reset   string
 	Red     string
@@ -48,554 +402,4983 @@ var Colors = struct {
 	White:   "\033[97m",
 }
 
+// InstanceName heads the notifications, set by --instance-name.
+var InstanceName = DefaultInstanceName
+
+// NoColor disables the ANSI colors of Colored. It defaults to true when
+// stderr, where the logs go, is not a terminal or NO_COLOR is set.
+var NoColor = os.Getenv("NO_COLOR") != "" || !isTerminal(os.Stderr)
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
 func Colored(color string, a ...any) string {
+	if NoColor {
+		return fmt.Sprint(a...)
+	}
 	return color + fmt.Sprint(a...) + Colors.reset
 }
 
-type AvialableFlight struct {
-	Economy       bool
-	Business      bool
-	DepartureDate time.Time
+// LogFields are the structured fields attached to a log line in json format.
+type LogFields struct {
+	Event string
+	Route string
+	Day   string
 }
 
-type AvialableFlights map[string][]AvialableFlight
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Event   string    `json:"event"`
+	Route   string    `json:"route,omitempty"`
+	Day     string    `json:"day,omitempty"`
+	Message string    `json:"message"`
+}
 
-type TelegramRequest struct {
-	Client *http.Client
-	BotKey string
-	ChatID string
+// LogLevels orders the log levels from the most to the least severe.
+var LogLevels = map[string]int{"error": 0, "warn": 1, "info": 2, "debug": 3}
+
+type Logger struct {
+	// Format is either "text" (colored lines) or "json" (one object per line, no colors).
+	Format string
+	// Level is the least severe level that is logged, one of LogLevels.
+	Level string
 }
 
-func (telegramRequest *TelegramRequest) sendTelegramMessage(message string) error {
-	url := fmt.Sprintf(TelegramAPIURL, telegramRequest.BotKey)
+var logger = &Logger{Format: "text", Level: "info"}
 
-	req, err := http.NewRequest("POST", url, nil)
+func (logger *Logger) log(level, color string, fields LogFields, a ...any) {
+	if LogLevels[level] > LogLevels[logger.Level] {
+		return
+	}
+	if logger.Format != "json" {
+		log.Println(Colored(color, a...))
+		return
+	}
+	entry, err := json.Marshal(LogEntry{
+		Time:    time.Now(),
+		Level:   level,
+		Event:   fields.Event,
+		Route:   fields.Route,
+		Day:     fields.Day,
+		Message: fmt.Sprint(a...),
+	})
 	if err != nil {
-		return err
+		log.Println(err)
+		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	q := req.URL.Query()
-	q.Add("chat_id", telegramRequest.ChatID)
-	q.Add("text", message)
-	q.Add("parse_mode", "HTML")
-	req.URL.RawQuery = q.Encode()
+	fmt.Fprintln(log.Writer(), string(entry))
+}
 
-	resp, err := telegramRequest.Client.Do(req)
+func (logger *Logger) Error(fields LogFields, a ...any) {
+	logger.log("error", Colors.Red, fields, a...)
+}
+
+func (logger *Logger) Warn(fields LogFields, a ...any) {
+	logger.log("warn", Colors.Yellow, fields, a...)
+}
+
+func (logger *Logger) Info(fields LogFields, a ...any) {
+	logger.log("info", Colors.Green, fields, a...)
+}
+
+func (logger *Logger) Debug(fields LogFields, a ...any) {
+	logger.log("debug", Colors.Gray, fields, a...)
+}
+
+// RotatingFile is a log file that is rotated once it would grow past MaxSize bytes.
+// The rotated files are kept as path.1 (the newest) up to path.<Backups>.
+type RotatingFile struct {
+	mu      sync.Mutex
+	Path    string
+	MaxSize int64
+	Backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	rotatingFile := &RotatingFile{Path: path, MaxSize: maxSize, Backups: backups}
+	if err := rotatingFile.open(); err != nil {
+		return nil, err
+	}
+	return rotatingFile, nil
+}
+
+func (rotatingFile *RotatingFile) open() error {
+	file, err := os.OpenFile(rotatingFile.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("error: telegram send message status code: %d", resp.StatusCode)
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
 	}
+	rotatingFile.file, rotatingFile.size = file, stat.Size()
 	return nil
 }
 
-func (telegramRequest *TelegramRequest) sendTelegramFlightNotification(avialableFlights AvialableFlights) error {
-	message := "Azal Bot Flights\n\n"
-	for day, flights := range avialableFlights {
-		message += fmt.Sprintf("%s\n-----------\n", day)
-		for _, flight := range flights {
-			classes := ""
-			if flight.Economy {
-				classes += "Economy"
-			}
-			if flight.Business {
-				if classes != "" {
-					classes += ", "
-				}
-				classes += "Business"
-			}
-			message += fmt.Sprintf("%s (%s)\n", flight.DepartureDate.Format("15:04:05"), classes)
+func (rotatingFile *RotatingFile) rotate() error {
+	if err := rotatingFile.file.Close(); err != nil {
+		return err
+	}
+	if rotatingFile.Backups == 0 {
+		os.Remove(rotatingFile.Path)
+	} else {
+		for i := rotatingFile.Backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rotatingFile.Path, i), fmt.Sprintf("%s.%d", rotatingFile.Path, i+1))
+		}
+		if err := os.Rename(rotatingFile.Path, rotatingFile.Path+".1"); err != nil {
+			return err
 		}
-		message += "\n"
 	}
-	message = message[:len(message)-1]
-	return telegramRequest.sendTelegramMessage(message)
+	return rotatingFile.open()
 }
 
-func (telegramRequest *TelegramRequest) sendTelegramStartNotification(botConfig *BotConfig) error {
-	return telegramRequest.sendTelegramMessage(
-		fmt.Sprintf(
-			"Azal Bot started\n\nFrom: %s\nTo: %s\nFirst Date: %s\nLast Date: %s\nRepetition Interval: %s",
-			botConfig.From,
-			botConfig.To,
-			botConfig.FirstDate.Format("2006-01-02T15:04:05"),
-			botConfig.LastDate.Format("2006-01-02T15:04:05"),
-			botConfig.RepetInterval.String(),
-		),
-	)
+func (rotatingFile *RotatingFile) Write(p []byte) (int, error) {
+	rotatingFile.mu.Lock()
+	defer rotatingFile.mu.Unlock()
+	if rotatingFile.size > 0 && rotatingFile.size+int64(len(p)) > rotatingFile.MaxSize {
+		if err := rotatingFile.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rotatingFile.file.Write(p)
+	rotatingFile.size += int64(n)
+	return n, err
 }
 
-func (telegramRequest *TelegramRequest) sendTelegramErrorNotification(err error) error {
-	return telegramRequest.sendTelegramMessage(fmt.Sprintf("Azal Bot Error: %s", err.Error()))
+func (rotatingFile *RotatingFile) Close() error {
+	rotatingFile.mu.Lock()
+	defer rotatingFile.mu.Unlock()
+	return rotatingFile.file.Close()
 }
 
-type UserInput struct {
-	FirstDate      time.Time
-	LastDate       time.Time
-	From           string
-	To             string
-	TelegramBotKey string
-	TelegramChatID string
-	RepetInterval  time.Duration
+// ansiEscape matches the color sequences of Colors.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// noColorWriter strips the ANSI colors before writing to w, so a log file
+// stays plain text while the terminal gets colored output. The log package
+// writes a line at a time, so a sequence is never split across writes.
+type noColorWriter struct {
+	w io.Writer
 }
 
-type BotConfig struct {
-	FirstDate     time.Time
-	LastDate      time.Time
-	From          string
-	To            string
-	days          []string
-	RepetInterval time.Duration
+func (noColorWriter noColorWriter) Write(p []byte) (int, error) {
+	if _, err := noColorWriter.w.Write(ansiEscape.ReplaceAll(p, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-type ResponseTime struct {
-	time.Time
+// ExchangeRate converts the fares from the search currency to --display-currency.
+type ExchangeRate struct {
+	From string
+	To   string
+	Rate float64
 }
 
-func (responseTime *ResponseTime) UnmarshalJSON(b []byte) error {
-	s := string(b)
-	s = s[1 : len(s)-1]
+// displayRate is fetched once at startup; nil when --display-currency is not set or the fetch failed.
+var displayRate *ExchangeRate
+
+// convertedPrice renders the price in the display currency as " (≈ 87.62 USD)", or "" without a rate for it.
+func convertedPrice(price azal.Price) string {
+	if displayRate == nil || price.Currency != displayRate.From {
+		return ""
+	}
+	return fmt.Sprintf(" (≈ %.2f %s)", price.Amount*displayRate.Rate, displayRate.To)
+}
 
-	t, err := time.Parse("2006-01-02T15:04:05", s)
+// fetchExchangeRate gets the rate from one currency to another from an
+// exchangerate-api.com style endpoint, which returns {"rates": {"USD": 0.588, ...}}.
+func fetchExchangeRate(client *http.Client, fxURL, from, to string) (*ExchangeRate, error) {
+	resp, err := client.Get(strings.ReplaceAll(fxURL, "{currency}", url.PathEscape(from)))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	responseTime.Time = t
-	return nil
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("error: exchange rate status code: %d", resp.StatusCode)
+	}
+	var data struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("error: parsing exchange rates: %v", err)
+	}
+	rate, ok := data.Rates[to]
+	if !ok || rate <= 0 {
+		return nil, fmt.Errorf("error: no exchange rate from %s to %s", from, to)
+	}
+	return &ExchangeRate{From: from, To: to, Rate: rate}, nil
 }
 
-type SuccessResponse struct {
-	Warnings []any `json:"warnings"`
-	Search   struct {
-		OptionSets []struct {
-			Options []struct {
-				ID                         string `json:"id"`
-				Available                  bool   `json:"available"`
-				CheapestEconomySolutionId  string `json:"cheapestEconomySolutionId"`
-				CheapestBusinessSolutionId string `json:"cheapestBusinessSolutionId"`
-				Route                      struct {
-					ID            string       `json:"id"`
-					DepartureDate ResponseTime `json:"departureDate"`
-				} `json:"route"`
-			} `json:"options"`
-		} `json:"optionSets"`
-	} `json:"search"`
+type AvialableFlight struct {
+	Economy       bool
+	Business      bool
+	EconomyPrice  *azal.Price `json:",omitempty"`
+	BusinessPrice *azal.Price `json:",omitempty"`
+	// Seats is the number of seats left, 0 if unknown.
+	Seats         int `json:",omitempty"`
+	DepartureDate time.Time
+	// ArrivalDate is zero when the API doesn't tell.
+	ArrivalDate time.Time
+	BookingURL  string `json:",omitempty"`
+	// ID is the API's route ID of the flight, empty in state files written before it was kept.
+	ID string `json:",omitempty"`
+	// New is set on the flights that weren't in the previous notification.
+	New bool `json:"-"`
+	// Fares lists every fare family of the flight with --all-fares.
+	Fares []Fare `json:",omitempty"`
+	// SoldOut marks a flight the API lists as not available, kept with --include-sold-out.
+	SoldOut bool `json:",omitempty"`
 }
 
-type ErrorResponse struct {
-	Error struct {
-		Code string `json:"code"`
-		Text string `json:"text"`
-	} `json:"error"`
+// Fare is the price of one fare family of a flight.
+type Fare struct {
+	Family string     `json:"family,omitempty"`
+	Price  azal.Price `json:"price"`
 }
 
-type HeaderConfig struct {
-	Host           string `req_header:"Host"`
-	UserAgent      string `req_header:"User-Agent"`
-	Accept         string `req_header:"Accept"`
-	AcceptLanguage string `req_header:"Accept-Language"`
-	AcceptEncoding string `req_header:"Accept-Encoding"`
-	XApplication   string `req_header:"x-application"`
-	XLocale        string `req_header:"x-locale"`
-	Connection     string `req_header:"Connection"`
-	Referer        string `req_header:"Referer"`
-	SecFetchDest   string `req_header:"Sec-Fetch-Dest"`
-	SecFetchMode   string `req_header:"Sec-Fetch-Mode"`
-	SecFetchSite   string `req_header:"Sec-Fetch-Site"`
-	TE             string `req_header:"TE"`
+func (fare Fare) String() string {
+	return fare.Family + " " + fare.Price.String() + convertedPrice(fare.Price)
 }
 
-func (headerConf *HeaderConfig) setDefaults() {
-	if headerConf.Host == "" {
-		headerConf.Host = "book.azal.az"
-	}
-	if headerConf.UserAgent == "" {
-		headerConf.UserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0"
+// optionFares lists the fares of the option, cheapest first. A fare without
+// a family name is named after its class if it's the cheapest one of it.
+func optionFares(successResponse *azal.SuccessResponse, option azal.ResponseOption) []Fare {
+	var fares []Fare
+	for _, solution := range successResponse.OptionSolutions(option) {
+		family := solution.FareFamily
+		if family == "" {
+			switch solution.ID {
+			case option.CheapestEconomySolutionId:
+				family = "Economy"
+			case option.CheapestBusinessSolutionId:
+				family = "Business"
+			default:
+				family = "Fare"
+			}
+		}
+		fares = append(fares, Fare{Family: family, Price: solution.Price})
 	}
-	if headerConf.Accept == "" {
-		headerConf.Accept = "application/json, text/plain, */*"
+	return fares
+}
+
+// sameFlight matches flights by ID, or by departure time when one of them has no ID.
+// A sold-out flight doesn't match the bookable one, so a flight that becomes bookable is new.
+func sameFlight(a, b AvialableFlight) bool {
+	if a.SoldOut != b.SoldOut {
+		return false
 	}
-	if headerConf.AcceptLanguage == "" {
-		headerConf.AcceptLanguage = "en-US,en;q=0.5"
+	if a.ID != "" && b.ID != "" {
+		return a.ID == b.ID
 	}
-	if headerConf.AcceptEncoding == "" {
-		headerConf.AcceptEncoding = "gzip, deflate, br"
+	return a.DepartureDate.Equal(b.DepartureDate)
+}
+
+// shortID shortens the ID for the logs.
+func (avialableFlight AvialableFlight) shortID() string {
+	if len(avialableFlight.ID) > 12 {
+		return avialableFlight.ID[:12]
 	}
-	if headerConf.XApplication == "" {
-		headerConf.XApplication = "ibe"
+	return avialableFlight.ID
+}
+
+func (avialableFlight AvialableFlight) classes() string {
+	if avialableFlight.SoldOut {
+		return "SOLD OUT"
 	}
-	if headerConf.XLocale == "" {
-		headerConf.XLocale = "az"
+	classes := ""
+	if avialableFlight.Economy {
+		classes += "Economy"
+		if avialableFlight.EconomyPrice != nil {
+			classes += " " + avialableFlight.EconomyPrice.String() + convertedPrice(*avialableFlight.EconomyPrice)
+		}
 	}
-	if headerConf.Connection == "" {
-		headerConf.Connection = "keep-alive"
+	if avialableFlight.Business {
+		if classes != "" {
+			classes += ", "
+		}
+		classes += "Business"
+		if avialableFlight.BusinessPrice != nil {
+			classes += " " + avialableFlight.BusinessPrice.String() + convertedPrice(*avialableFlight.BusinessPrice)
+		}
 	}
-	if headerConf.SecFetchDest == "" {
-		headerConf.SecFetchDest = "empty"
+	if avialableFlight.Seats > 0 {
+		classes += fmt.Sprintf(", %d seat(s) left", avialableFlight.Seats)
 	}
-	if headerConf.SecFetchMode == "" {
-		headerConf.SecFetchMode = "cors"
+	return classes
+}
+
+// arrival renders " → 15:04 (1h 5m)" with a "+N" day marker for overnight flights,
+// or "" when the arrival time is unknown.
+func (avialableFlight AvialableFlight) arrival() string {
+	if avialableFlight.ArrivalDate.IsZero() {
+		return ""
 	}
-	if headerConf.SecFetchSite == "" {
-		headerConf.SecFetchSite = "same-origin"
+	departureDate, arrivalDate := avialableFlight.DepartureDate.In(Timezone), avialableFlight.ArrivalDate.In(Timezone)
+	arrival := " → " + arrivalDate.Format(shortTimeFormat())
+	departureDay := time.Date(departureDate.Year(), departureDate.Month(), departureDate.Day(), 0, 0, 0, 0, time.UTC)
+	arrivalDay := time.Date(arrivalDate.Year(), arrivalDate.Month(), arrivalDate.Day(), 0, 0, 0, 0, time.UTC)
+	if days := int(arrivalDay.Sub(departureDay).Hours() / 24); days > 0 {
+		arrival += fmt.Sprintf("+%d", days)
 	}
-	if headerConf.TE == "" {
-		headerConf.TE = "trailers"
+	duration := avialableFlight.ArrivalDate.Sub(avialableFlight.DepartureDate).Round(time.Minute)
+	return arrival + fmt.Sprintf(" (%dh %dm)", int(duration.Hours()), int(duration.Minutes())%60)
+}
+
+func (avialableFlight AvialableFlight) cheapestPrice() *azal.Price {
+	price := avialableFlight.EconomyPrice
+	if price == nil || (avialableFlight.BusinessPrice != nil && avialableFlight.BusinessPrice.Amount < price.Amount) {
+		price = avialableFlight.BusinessPrice
 	}
+	return price
 }
 
-func (headerConf *HeaderConfig) setToRequest(req *http.Request) {
-	t := reflect.TypeOf(*headerConf)
-	v := reflect.ValueOf(headerConf).Elem()
+// AvialableFlights is keyed by "FROM-TO day", with a " (return)" suffix for return legs.
+type AvialableFlights map[string][]AvialableFlight
 
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		tag := field.Tag.Get("req_header")
-		value := v.Field(i).String()
-		req.Header.Set(tag, value)
+const returnKeySuffix = " (return)"
+
+func flightKey(route Route, day string, isReturn bool) string {
+	key := route.String() + " " + day
+	if isReturn {
+		key += returnKeySuffix
 	}
+	return key
 }
 
-type QueryConfig struct {
-	Lang          string `req_query:"lang"`
-	From          string `req_query:"from"`
-	To            string `req_query:"to"`
-	DepartureDate string `req_query:"departure_date"`
-	TripType      string `req_query:"tripType"`
-	AdultCount    string `req_query:"adult_count"`
-	ChildCount    string `req_query:"child_count"`
-	InfantCount   string `req_query:"infant_count"`
-	IsStudent     string `req_query:"is_student"`
-	Timestamp     string `req_query:"timestamp"`
-	IsCitizen     string `req_query:"is_citizen"`
-	Currency      string `req_query:"currency"`
-	Theme         string `req_query:"theme"`
+// bookable reports whether any of the flights is not sold out.
+func (avialableFlights AvialableFlights) bookable() bool {
+	for _, flights := range avialableFlights {
+		for _, flight := range flights {
+			if !flight.SoldOut {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (queryConf *QueryConfig) setDefaults() {
-	if queryConf.Lang == "" {
-		queryConf.Lang = "az"
+// keys returns the keys sorted, so output built from them is deterministic.
+func (avialableFlights AvialableFlights) keys() []string {
+	keys := make([]string, 0, len(avialableFlights))
+	for key := range avialableFlights {
+		keys = append(keys, key)
 	}
-	if queryConf.TripType == "" {
-		queryConf.TripType = "OW"
-	}
-	if queryConf.AdultCount == "" {
-		queryConf.AdultCount = "1"
+	sort.Strings(keys)
+	return keys
+}
+
+// flightIdentity identifies a single departure across checks.
+func flightIdentity(key string, flight AvialableFlight) string {
+	if flight.ID != "" {
+		return key + " " + flight.ID
 	}
-	if queryConf.ChildCount == "" {
-		queryConf.ChildCount = "0"
+	return key + " " + flight.DepartureDate.Format(time.RFC3339)
+}
+
+func parseFlightKey(key string) (route, day string, isReturn bool) {
+	key, isReturn = strings.CutSuffix(key, returnKeySuffix)
+	route, day, _ = strings.Cut(key, " ")
+	return route, day, isReturn
+}
+
+// splitRoutes moves the flights of the given routes into their own sets and returns the rest.
+func (avialableFlights AvialableFlights) splitRoutes(routes map[string]bool) (AvialableFlights, map[string]AvialableFlights) {
+	rest := make(AvialableFlights)
+	split := make(map[string]AvialableFlights)
+	for key, flights := range avialableFlights {
+		route, _, _ := parseFlightKey(key)
+		if !routes[route] {
+			rest[key] = flights
+			continue
+		}
+		if split[route] == nil {
+			split[route] = make(AvialableFlights)
+		}
+		split[route][key] = flights
 	}
-	if queryConf.InfantCount == "" {
-		queryConf.InfantCount = "0"
+	return rest, split
+}
+
+// DateFormatPresets and TimeFormatPresets are the named --date-format and
+// --time-format values; anything else is used as a Go time layout.
+var (
+	DateFormatPresets = map[string]string{
+		"iso":  "2006-01-02",
+		"eu":   "02.01.2006",
+		"us":   "01/02/2006",
+		"long": "Mon, 2 Jan 2006",
 	}
-	if queryConf.IsStudent == "" {
-		queryConf.IsStudent = "0"
+	TimeFormatPresets = map[string]string{
+		"24h": "15:04",
+		"12h": "3:04 PM",
 	}
-	if queryConf.Timestamp == "" {
-		queryConf.Timestamp = fmt.Sprintf("%d", time.Now().UnixNano()/int64(time.Millisecond))
+)
+
+// DateFormat and TimeFormat lay out the days and the departure times of the
+// notifications and the logs, set by --date-format and --time-format.
+var (
+	DateFormat = "2006-01-02"
+	TimeFormat = "15:04:05"
+)
+
+// shortTimeFormat is TimeFormat without the seconds, for the arrival times and the compact lines.
+func shortTimeFormat() string {
+	return strings.Replace(TimeFormat, ":05", "", 1)
+}
+
+// formatDay lays out a "2006-01-02" day with DateFormat.
+func formatDay(day string) string {
+	t, err := time.ParseInLocation("2006-01-02", day, Timezone)
+	if err != nil {
+		return day
 	}
-	if queryConf.IsCitizen == "" {
-		queryConf.IsCitizen = "1"
+	return t.Format(DateFormat)
+}
+
+// formatDeparture lays out a departure in Timezone with DateFormat and TimeFormat, for the logs.
+func formatDeparture(t time.Time) string {
+	return t.In(Timezone).Format(DateFormat + " " + TimeFormat)
+}
+
+// parseLayout resolves a --date-format or --time-format value to a Go time layout.
+// A layout without any date or time element is rejected, it would print the same text for every flight.
+func parseLayout(value string, presets map[string]string) (string, error) {
+	if layout, ok := presets[strings.ToLower(value)]; ok {
+		return layout, nil
 	}
-	if queryConf.Currency == "" {
-		queryConf.Currency = "AZN"
+	if strings.TrimSpace(value) == "" {
+		return "", errors.New("can't be empty")
 	}
-	if queryConf.Theme == "" {
-		queryConf.Theme = "dark"
+	reference := time.Date(2001, 11, 12, 13, 14, 15, 0, time.UTC)
+	if reference.Format(value) == value {
+		return "", fmt.Errorf("%q has no date or time element, expected a Go layout like 02.01.2006 or a preset", value)
 	}
+	return value, nil
 }
 
-func (queryConf *QueryConfig) setToRequest(req *http.Request) {
-	q := req.URL.Query()
-	t := reflect.TypeOf(*queryConf)
-	v := reflect.ValueOf(queryConf).Elem()
+// DefaultMessageTemplate renders the flight notifications unless --message-template is given.
+const DefaultMessageTemplate = `{{.Instance}} Flights
+{{range .Days}}
+{{.Heading}}
+-----------
+{{range .Flights}}{{time .DepartureDate}}{{arrival .}} ({{classes .}}){{if .New}} - new{{end}}
+{{range .Fares}}    {{.}}
+{{end}}{{end}}{{end}}{{if .New}}
+{{.New}} new flight(s) since the last notification.
+{{end}}{{if .Suppressed}}
+{{.Suppressed}} notification(s) were held back by the daily limit.
+{{end}}`
 
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		tag := field.Tag.Get("req_query")
-		value := v.Field(i).String()
-		q.Add(tag, value)
-	}
+// CompactMessageTemplate renders a line per flight with --compact, short enough
+// for the preview of a push notification.
+const CompactMessageTemplate = `{{range .Days}}{{$route := replace .Route "-" "→"}}{{range .Flights}}` +
+	`{{$route}} {{date .DepartureDate}} {{shortTime .DepartureDate}}{{if .SoldOut}} SOLD OUT{{else}}{{with price .}} ({{.}}){{end}}{{end}}{{if .New}} new{{end}}
+{{end}}{{end}}`
 
-	req.URL.RawQuery = q.Encode()
+// CompactMessages makes removedMessage list a line per flight too, set by --compact.
+var CompactMessages bool
+
+// MessageTemplate is the parsed template used by AvialableFlights.message.
+var MessageTemplate = template.Must(parseMessageTemplate(DefaultMessageTemplate))
+
+// MessageData is the data passed to the message template.
+type MessageData struct {
+	Days []MessageDay
+	// Suppressed is the number of notifications held back by --max-notifications-per-day since the previous one.
+	Suppressed int
+	// New is the number of flights with New set.
+	New int
+	// Instance is the --instance-name.
+	Instance string
 }
 
-func handleErrorResponse(errorResponse *ErrorResponse) error {
-	switch errorResponse.Error.Code {
-	case "no.flights.available":
-		return ErrorNoFlightsAvailable
-	case "flow.interrupted.error":
-		return ErrorFlowInterrupted
-	default:
-		return fmt.Errorf("unknown error: %s", errorResponse.Error.Code)
-	}
+// DefaultBookingURLTemplate renders the booking links unless --booking-url-template is given.
+// It opens the same search on azal.BookingURL as the API request.
+const DefaultBookingURLTemplate = azal.BookingURL + `?from={{.From}}&to={{.To}}` +
+	`&departure_date={{.Date}}{{if .ReturnDate}}&return_date={{.ReturnDate}}{{end}}&tripType={{.TripType}}` +
+	`&adult_count={{.Adults}}&child_count={{.Children}}&infant_count={{.Infants}}` +
+	`{{with .InfantsWithSeat}}&infant_with_seat_count={{.}}{{end}}` +
+	`&currency={{.Currency}}&lang={{.Lang}}&is_citizen=1&is_student=0&theme=dark`
+
+// BookingURLTemplate is the parsed template used by bookingURL.
+var BookingURLTemplate = template.Must(template.New("booking").Parse(DefaultBookingURLTemplate))
+
+// BookingURLData is the data passed to the booking URL template.
+type BookingURLData struct {
+	From       string
+	To         string
+	Date       string
+	ReturnDate string
+	TripType   string
+	Adults     string
+	Children   string
+	Infants    string
+	// InfantsWithSeat is empty when no infant has its own seat.
+	InfantsWithSeat string
+	Currency        string
+	Lang            string
 }
 
-func sendRequest(client *http.Client, queryConf *QueryConfig, headerConf *HeaderConfig) (*SuccessResponse, error) {
-	req, err := http.NewRequest("GET", RequestURL, nil)
+// bookingURL renders the azal.az link that opens the search of queryConf in a browser.
+func bookingURL(queryConf *azal.QueryConfig) (string, error) {
+	var link strings.Builder
+	err := BookingURLTemplate.Execute(&link, BookingURLData{
+		From:            queryConf.From,
+		To:              queryConf.To,
+		Date:            queryConf.DepartureDate,
+		ReturnDate:      queryConf.ReturnDate,
+		TripType:        queryConf.TripType,
+		Adults:          queryConf.AdultCount,
+		Children:        queryConf.ChildCount,
+		Infants:         queryConf.InfantCount,
+		InfantsWithSeat: queryConf.InfantWithSeatCount,
+		Currency:        queryConf.Currency,
+		Lang:            queryConf.Lang,
+	})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	if u, err := url.Parse(link.String()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("booking url template: %q is not an http(s) URL", link.String())
+	}
+	return link.String(), nil
+}
 
-	headerConf.setToRequest(req)
-	queryConf.setToRequest(req)
-
-	resp, err := client.Do(req)
+// flightBookingURL is bookingURL for a notification: a link that can't be rendered is left out.
+func flightBookingURL(queryConf *azal.QueryConfig) string {
+	link, err := bookingURL(queryConf)
 	if err != nil {
-		return nil, err
+		logger.Error(LogFields{Event: "template_failed"}, err.Error())
 	}
-	defer resp.Body.Close()
+	return link
+}
 
-	var data map[string]interface{}
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// suppressedNotifications is set by startBot while it sends a notification after held back ones.
+var suppressedNotifications int
+
+type MessageDay struct {
+	Key   string
+	Route string
+	Day   string
+	// Heading is Key with the day in --date-format.
+	Heading string
+	Return  bool
+	Flights []AvialableFlight
+}
+
+func parseMessageTemplate(text string) (*template.Template, error) {
+	return template.New("message").Funcs(template.FuncMap{
+		"classes":   func(flight AvialableFlight) string { return flight.classes() },
+		"arrival":   func(flight AvialableFlight) string { return flight.arrival() },
+		"price":     func(flight AvialableFlight) *azal.Price { return flight.cheapestPrice() },
+		"replace":   strings.ReplaceAll,
+		"date":      func(t time.Time) string { return t.In(Timezone).Format(DateFormat) },
+		"time":      func(t time.Time) string { return t.In(Timezone).Format(TimeFormat) },
+		"shortTime": func(t time.Time) string { return t.In(Timezone).Format(shortTimeFormat()) },
+	}).Parse(text)
+}
+
+func (avialableFlights AvialableFlights) message() string {
+	data := MessageData{Suppressed: suppressedNotifications, Instance: InstanceName}
+	for _, key := range avialableFlights.keys() {
+		route, day, isReturn := parseFlightKey(key)
+		heading := route + " " + formatDay(day)
+		if isReturn {
+			heading += returnKeySuffix
+		}
+		data.Days = append(data.Days, MessageDay{
+			Key:     key,
+			Route:   route,
+			Day:     day,
+			Heading: heading,
+			Return:  isReturn,
+			Flights: avialableFlights[key],
+		})
+		for _, flight := range avialableFlights[key] {
+			if flight.New {
+				data.New++
+			}
+		}
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("status code: %d", resp.StatusCode)
+	var message strings.Builder
+	if err := MessageTemplate.Execute(&message, data); err != nil {
+		logger.Error(LogFields{Event: "template_failed"}, err.Error())
+		return InstanceName + " Flights\n\nerror rendering the message template"
 	}
-	if err := json.Unmarshal(respBody, &data); err != nil {
-		return nil, err
+	return message.String()
+}
+
+// removedMessage lists the departures that disappeared since the previous check.
+func (avialableFlights AvialableFlights) removedMessage() string {
+	if CompactMessages {
+		var lines []string
+		for _, key := range avialableFlights.keys() {
+			route, _, _ := parseFlightKey(key)
+			for _, flight := range avialableFlights[key] {
+				lines = append(lines, strings.Replace(route, "-", "→", 1)+" "+flight.DepartureDate.In(Timezone).Format(DateFormat+" "+shortTimeFormat())+" no longer available")
+			}
+		}
+		return strings.Join(lines, "\n")
 	}
-	errorResponseData := &ErrorResponse{}
-	if err := json.Unmarshal(respBody, &errorResponseData); err != nil {
-		return nil, err
+	message := InstanceName + " Flights No Longer Available\n"
+	for _, key := range avialableFlights.keys() {
+		route, day, isReturn := parseFlightKey(key)
+		heading := route + " " + formatDay(day)
+		if isReturn {
+			heading += returnKeySuffix
+		}
+		message += fmt.Sprintf("\n%s\n-----------\n", heading)
+		for _, flight := range avialableFlights[key] {
+			message += flight.DepartureDate.In(Timezone).Format(TimeFormat) + "\n"
+		}
 	}
-	if errorResponseData.Error.Code != "" {
-		return nil, handleErrorResponse(errorResponseData)
+	return message
+}
+
+// DiffFlights compares two results by day and flight (see sameFlight) and returns
+// the flights that appear only in current (added) and only in previous (removed).
+func DiffFlights(previous, current AvialableFlights) (added, removed AvialableFlights) {
+	added, removed = make(AvialableFlights), make(AvialableFlights)
+	contains := func(flights []AvialableFlight, flight AvialableFlight) bool {
+		for _, f := range flights {
+			if sameFlight(f, flight) {
+				return true
+			}
+		}
+		return false
 	}
-	successResponseData := &SuccessResponse{}
-	if err := json.Unmarshal(respBody, &successResponseData); err != nil {
-		return nil, err
+	for day, flights := range current {
+		for _, flight := range flights {
+			if !contains(previous[day], flight) {
+				added[day] = append(added[day], flight)
+			}
+		}
+	}
+	for day, flights := range previous {
+		for _, flight := range flights {
+			if !contains(current[day], flight) {
+				removed[day] = append(removed[day], flight)
+			}
+		}
 	}
-	return successResponseData, nil
+	return added, removed
 }
 
-func getUserInput() *UserInput {
-	var (
-		firstDate,
+// merge adds the flights of other that aren't in avialableFlights yet, matched by day
+// and flight (see sameFlight). Flights already present are updated to their latest fares.
+func (avialableFlights AvialableFlights) merge(other AvialableFlights) {
+	for day, flights := range other {
+		for _, flight := range flights {
+			i := slices.IndexFunc(avialableFlights[day], func(f AvialableFlight) bool {
+				return sameFlight(f, flight)
+			})
+			if i >= 0 {
+				avialableFlights[day][i] = flight
+			} else {
+				avialableFlights[day] = append(avialableFlights[day], flight)
+			}
+		}
+		slices.SortFunc(avialableFlights[day], func(a, b AvialableFlight) int {
+			return a.DepartureDate.Compare(b.DepartureDate)
+		})
+	}
+}
+
+// State is what the state file keeps across restarts.
+type State struct {
+	Flights AvialableFlights `json:"flights"`
+	// StartNotified is when the last start notification was sent, for --daily-start-notification.
+	StartNotified time.Time `json:"start_notified,omitempty"`
+}
+
+// loadState reads the state file. Older state files hold only the flights map.
+func loadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	state := &State{Flights: make(AvialableFlights)}
+	if _, ok := fields["flights"]; !ok {
+		if err := json.Unmarshal(data, &state.Flights); err != nil {
+			return nil, err
+		}
+		return state, nil
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func saveState(path string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a truncated state file behind.
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// startNotifiedToday reports whether the state file records a start notification sent today, in Timezone.
+func startNotifiedToday(path string) bool {
+	state, err := loadState(path)
+	if err != nil {
+		return false
+	}
+	last, now := state.StartNotified.In(Timezone), time.Now().In(Timezone)
+	return last.Year() == now.Year() && last.YearDay() == now.YearDay()
+}
+
+// markStartNotified records in the state file that the start notification was sent now.
+func markStartNotified(path string) error {
+	state, err := loadState(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		state = &State{Flights: make(AvialableFlights)}
+	}
+	state.StartNotified = time.Now()
+	return saveState(path, state)
+}
+
+// appendCSV appends every flight to the CSV file at path, writing the header first if the file is new.
+func appendCSV(path string, avialableFlights AvialableFlights) error {
+	_, err := os.Stat(path)
+	newFile := os.IsNotExist(err)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if newFile {
+		w.Write([]string{"timestamp", "route", "day", "departure_time", "price"})
+	}
+	timestamp := time.Now().Format(time.RFC3339)
+	for _, key := range avialableFlights.keys() {
+		route, day, _ := parseFlightKey(key)
+		for _, flight := range avialableFlights[key] {
+			price := ""
+			if cheapest := flight.cheapestPrice(); cheapest != nil {
+				price = cheapest.String()
+			}
+			w.Write([]string{timestamp, route, day, flight.DepartureDate.In(Timezone).Format("15:04:05"), price})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+type TelegramRequest struct {
+	// Context cancels the messages being sent when the bot stops; nil means context.Background.
+	Context context.Context
+	Client  *http.Client
+	APIURL  string
+	BotKey  string
+	ChatIDs []string
+	DryRun  bool
+}
+
+// sendTelegramMessage sends the message to every chat, so one failing chat
+// doesn't prevent delivery to the others. The errors are joined.
+func (telegramRequest *TelegramRequest) sendTelegramMessage(message string) error {
+	return telegramRequest.sendTelegramMessageWithMarkup(message, "")
+}
+
+// sendTelegramMessageWithMarkup sends the message with an optional reply_markup.
+// If a chat rejects the markup, the message is sent again without it.
+func (telegramRequest *TelegramRequest) sendTelegramMessageWithMarkup(message, replyMarkup string) error {
+	var errs []error
+	for _, chatID := range telegramRequest.ChatIDs {
+		if telegramRequest.DryRun {
+			printDryRun("telegram chat "+chatID, message)
+			continue
+		}
+		err := telegramRequest.sendTelegramMessageToChat(chatID, message, replyMarkup)
+		var rateLimitError *TelegramRateLimitError
+		if err != nil && replyMarkup != "" && !errors.As(err, &rateLimitError) {
+			err = telegramRequest.sendTelegramMessageToChat(chatID, message, "")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("chat %s: %w", chatID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TelegramRateLimitError is a 429 response of the Bot API, which tells how long
+// to wait before sending again in parameters.retry_after.
+type TelegramRateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (rateLimitError *TelegramRateLimitError) Error() string {
+	return fmt.Sprintf("error: telegram send message rate limited, retry after %s", rateLimitError.RetryAfter)
+}
+
+// sendTelegramMessageToChat sends the message to a single chat. When Telegram
+// rate limits it, the message is sent again up to TelegramMaxRetries times after
+// the retry_after Telegram asked for, or an exponential jittered backoff if that is longer.
+func (telegramRequest *TelegramRequest) sendTelegramMessageToChat(chatID, message, replyMarkup string) error {
+	ctx := telegramRequest.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	delay := RetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := telegramRequest.postTelegramMessage(ctx, chatID, message, replyMarkup)
+		var rateLimitError *TelegramRateLimitError
+		if !errors.As(err, &rateLimitError) || attempt >= TelegramMaxRetries || rateLimitError.RetryAfter > TelegramMaxRetryAfter {
+			return err
+		}
+		wait := delay + rand.N(delay/2+1)
+		if rateLimitError.RetryAfter > wait {
+			wait = rateLimitError.RetryAfter
+		}
+		logger.Warn(
+			LogFields{Event: "telegram_rate_limited"},
+			"Telegram rate limited chat ", chatID, ", retrying in ", wait.Round(time.Millisecond),
+		)
+		if !sleepContext(ctx, wait) {
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (telegramRequest *TelegramRequest) postTelegramMessage(ctx context.Context, chatID, message, replyMarkup string) error {
+	url := fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimSuffix(telegramRequest.APIURL, "/"), telegramRequest.BotKey)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	q := req.URL.Query()
+	q.Add("chat_id", chatID)
+	q.Add("text", message)
+	q.Add("parse_mode", "HTML")
+	if replyMarkup != "" {
+		q.Add("reply_markup", replyMarkup)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	if Trace {
+		traceRequest(req)
+	}
+	resp, err := telegramRequest.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if Trace {
+		body, _ := io.ReadAll(resp.Body)
+		traceResponse(req, resp, body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var response struct {
+			Parameters struct {
+				RetryAfter int `json:"retry_after"`
+			} `json:"parameters"`
+		}
+		json.NewDecoder(resp.Body).Decode(&response)
+		io.Copy(io.Discard, resp.Body)
+		return &TelegramRateLimitError{RetryAfter: time.Duration(response.Parameters.RetryAfter) * time.Second}
+	}
+	// Drain the body so the keep-alive connection can be reused by the next message.
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("error: telegram send message status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// callTelegram calls a Bot API method and decodes its result into result, if not nil.
+// A failed call returns the API's description, e.g. "Unauthorized" or "Bad Request: chat not found".
+func (telegramRequest *TelegramRequest) callTelegram(method string, params url.Values, result any) error {
+	ctx := telegramRequest.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	url := fmt.Sprintf("%s/bot%s/%s?%s", strings.TrimSuffix(telegramRequest.APIURL, "/"), telegramRequest.BotKey, method, params.Encode())
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if Trace {
+		traceRequest(req)
+	}
+	resp, err := telegramRequest.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if Trace {
+		body, _ := io.ReadAll(resp.Body)
+		traceResponse(req, resp, body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	var response struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("error: telegram %s status code: %d", method, resp.StatusCode)
+	}
+	if !response.OK {
+		return fmt.Errorf("error: telegram %s status code: %d %s", method, resp.StatusCode, response.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// validate checks the bot key with getMe and that every chat is reachable with getChat.
+func (telegramRequest *TelegramRequest) validate() error {
+	if telegramRequest.DryRun {
+		return nil
+	}
+	var me struct {
+		Username string `json:"username"`
+	}
+	if err := telegramRequest.callTelegram("getMe", url.Values{}, &me); err != nil {
+		return fmt.Errorf("checking the bot key: %w", err)
+	}
+	logger.Debug(LogFields{Event: "telegram_validated"}, "Telegram bot @", me.Username)
+	for _, chatID := range telegramRequest.ChatIDs {
+		if err := telegramRequest.callTelegram("getChat", url.Values{"chat_id": {chatID}}, nil); err != nil {
+			return fmt.Errorf("checking chat %s: %w", chatID, err)
+		}
+	}
+	return nil
+}
+
+type TelegramInlineKeyboardButton struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+type TelegramInlineKeyboardMarkup struct {
+	InlineKeyboard [][]TelegramInlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// bookingKeyboard builds one booking button per route and day.
+func bookingKeyboard(avialableFlights AvialableFlights) (string, error) {
+	markup := TelegramInlineKeyboardMarkup{}
+	for _, key := range avialableFlights.keys() {
+		flights := avialableFlights[key]
+		if len(flights) == 0 || flights[0].BookingURL == "" {
+			continue
+		}
+		markup.InlineKeyboard = append(
+			markup.InlineKeyboard,
+			[]TelegramInlineKeyboardButton{{Text: "Book " + key, URL: flights[0].BookingURL}},
+		)
+	}
+	if len(markup.InlineKeyboard) == 0 {
+		return "", fmt.Errorf("no booking links")
+	}
+	data, err := json.Marshal(markup)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (telegramRequest *TelegramRequest) sendTelegramFlightNotification(avialableFlights AvialableFlights) error {
+	replyMarkup, err := bookingKeyboard(avialableFlights)
+	if err != nil {
+		logger.Warn(LogFields{Event: "booking_keyboard_failed"}, "Sending Telegram message without booking buttons: ", err.Error())
+		replyMarkup = ""
+	}
+	return telegramRequest.sendTelegramMessageWithMarkup(avialableFlights.message(), replyMarkup)
+}
+
+func (telegramRequest *TelegramRequest) sendTelegramRemovalNotification(removedFlights AvialableFlights) error {
+	return telegramRequest.sendTelegramMessage(removedFlights.removedMessage())
+}
+
+func (telegramRequest *TelegramRequest) sendTelegramStartNotification(botConfig *BotConfig) error {
+	return telegramRequest.sendTelegramMessage(botConfig.startMessage())
+}
+
+func (botConfig *BotConfig) startMessage() string {
+	message := InstanceName + " started\n\n"
+	for _, route := range botConfig.Routes {
+		message += fmt.Sprintf("From: %s\nTo: %s\n", route.From, route.To)
+	}
+	message += fmt.Sprintf(
+		"First Date: %s\nLast Date: %s\n",
+		botConfig.FirstDate.Format("2006-01-02T15:04:05"),
+		botConfig.LastDate.Format("2006-01-02T15:04:05"),
+	)
+	if !botConfig.ReturnDate.IsZero() {
+		message += fmt.Sprintf("Return Date: %s\n", botConfig.ReturnDate.Format("2006-01-02"))
+		if botConfig.ReturnRoute != nil {
+			message += fmt.Sprintf("Return Route: %s\n", botConfig.ReturnRoute)
+		}
+	}
+	message += fmt.Sprintf(
+		"Passengers: %d adult(s), %d child(ren), %d infant(s) on lap, %d infant(s) with seat\n",
+		botConfig.Adults,
+		botConfig.Children,
+		botConfig.Infants,
+		botConfig.InfantsWithSeat,
+	)
+	message += fmt.Sprintf("Currency: %s\n", botConfig.Currency)
+	message += fmt.Sprintf("Locale: %s\n", botConfig.Locale)
+	if botConfig.CabinClass != "" {
+		message += fmt.Sprintf("Cabin Class: %s\n", botConfig.CabinClass)
+	}
+	message += fmt.Sprintf("Timezone: %s\n", Timezone)
+	message += fmt.Sprintf("Repetition Interval: %s", botConfig.RepetInterval.String())
+	routes := make([]string, 0, len(botConfig.RouteIntervals))
+	for route := range botConfig.RouteIntervals {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		message += fmt.Sprintf("\nRepetition Interval (%s): %s", route, botConfig.RouteIntervals[route])
+	}
+	return message
+}
+
+// printDryRun prints a rendered message to stdout instead of sending it.
+func printDryRun(target, message string) {
+	fmt.Printf("----- dry run: %s -----\n%s\n\n", target, message)
+}
+
+func (telegramRequest *TelegramRequest) sendTelegramErrorNotification(err error) error {
+	return telegramRequest.sendTelegramMessage(fmt.Sprintf("%s Error: %s", InstanceName, err.Error()))
+}
+
+type DiscordRequest struct {
+	Client     *http.Client
+	WebhookURL string
+	DryRun     bool
+}
+
+func (discordRequest *DiscordRequest) sendDiscordMessage(message string) error {
+	if discordRequest.DryRun {
+		printDryRun("discord", message)
+		return nil
+	}
+	body, err := json.Marshal(map[string]string{"content": message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", discordRequest.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := discordRequest.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error: discord send message status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (discordRequest *DiscordRequest) sendDiscordFlightNotification(avialableFlights AvialableFlights) error {
+	// Discord rejects messages with empty content.
+	if len(avialableFlights) == 0 {
+		return nil
+	}
+	return discordRequest.sendDiscordMessage(avialableFlights.message())
+}
+
+func (discordRequest *DiscordRequest) sendDiscordRemovalNotification(removedFlights AvialableFlights) error {
+	return discordRequest.sendDiscordMessage(removedFlights.removedMessage())
+}
+
+type SlackRequest struct {
+	Client     *http.Client
+	WebhookURL string
+	DryRun     bool
+}
+
+// slackEscaper escapes the characters Slack treats as control sequences in message text.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (slackRequest *SlackRequest) sendSlackMessage(message string) error {
+	if slackRequest.DryRun {
+		printDryRun("slack", message)
+		return nil
+	}
+	body, err := json.Marshal(map[string]string{"text": slackEscaper.Replace(message)})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", slackRequest.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := slackRequest.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Slack explains the failure in a short plain text body, e.g. "invalid_payload" or "no_service".
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("error: slack send message status code: %d, response: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (slackRequest *SlackRequest) sendSlackFlightNotification(avialableFlights AvialableFlights) error {
+	if len(avialableFlights) == 0 {
+		return nil
+	}
+	return slackRequest.sendSlackMessage(avialableFlights.message())
+}
+
+func (slackRequest *SlackRequest) sendSlackRemovalNotification(removedFlights AvialableFlights) error {
+	return slackRequest.sendSlackMessage(removedFlights.removedMessage())
+}
+
+type PushoverRequest struct {
+	Client *http.Client
+	Token  string
+	User   string
+	DryRun bool
+}
+
+// PushoverMaxMessageLength is the longest message Pushover accepts.
+const PushoverMaxMessageLength = 1024
+
+func (pushoverRequest *PushoverRequest) sendPushoverMessage(title, message string) error {
+	if runes := []rune(message); len(runes) > PushoverMaxMessageLength {
+		message = string(runes[:PushoverMaxMessageLength-3]) + "..."
+	}
+	if pushoverRequest.DryRun {
+		printDryRun("pushover", title+"\n\n"+message)
+		return nil
+	}
+	form := url.Values{
+		"token":   {pushoverRequest.Token},
+		"user":    {pushoverRequest.User},
+		"title":   {title},
+		"message": {message},
+	}
+	resp, err := pushoverRequest.Client.PostForm(PushoverAPIURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Pushover explains the rejected fields in an errors array.
+		var errorResponse struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errorResponse)
+		return fmt.Errorf("error: pushover send message status code: %d %v", resp.StatusCode, errorResponse.Errors)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (pushoverRequest *PushoverRequest) sendPushoverFlightNotification(avialableFlights AvialableFlights) error {
+	return pushoverRequest.sendPushoverMessage(InstanceName+" Flights", avialableFlights.message())
+}
+
+func (pushoverRequest *PushoverRequest) sendPushoverRemovalNotification(removedFlights AvialableFlights) error {
+	return pushoverRequest.sendPushoverMessage(InstanceName+" Flights No Longer Available", removedFlights.removedMessage())
+}
+
+type NtfyRequest struct {
+	Client *http.Client
+	// URL is the topic URL, e.g. https://ntfy.sh/my-flights.
+	URL    string
+	Token  string
+	DryRun bool
+}
+
+func (ntfyRequest *NtfyRequest) sendNtfyMessage(title, priority, message string) error {
+	if ntfyRequest.DryRun {
+		printDryRun("ntfy "+ntfyRequest.URL, title+"\n\n"+message)
+		return nil
+	}
+	req, err := http.NewRequest("POST", ntfyRequest.URL, strings.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", title)
+	req.Header.Set("Priority", priority)
+	req.Header.Set("Tags", "airplane")
+	if ntfyRequest.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+ntfyRequest.Token)
+	}
+
+	resp, err := ntfyRequest.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error: ntfy send message status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (ntfyRequest *NtfyRequest) sendNtfyFlightNotification(avialableFlights AvialableFlights) error {
+	return ntfyRequest.sendNtfyMessage(InstanceName+" Flights", "high", avialableFlights.message())
+}
+
+func (ntfyRequest *NtfyRequest) sendNtfyRemovalNotification(removedFlights AvialableFlights) error {
+	return ntfyRequest.sendNtfyMessage(InstanceName+" Flights No Longer Available", "default", removedFlights.removedMessage())
+}
+
+type MatrixRequest struct {
+	Client     *http.Client
+	Homeserver string
+	Token      string
+	// Room is a room ID (!id:server) or alias (#alias:server); validate resolves an alias to its ID.
+	Room   string
+	DryRun bool
+}
+
+// do sends a client-server API request and decodes the JSON response into result.
+func (matrixRequest *MatrixRequest) do(method, path string, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(matrixRequest.Homeserver, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+matrixRequest.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := matrixRequest.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errorResponse struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errorResponse)
+		return fmt.Errorf("error: matrix status code: %d %s %s", resp.StatusCode, errorResponse.ErrCode, errorResponse.Error)
+	}
+	if result == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// validate checks the access token and that the bot has joined the room.
+func (matrixRequest *MatrixRequest) validate() error {
+	if matrixRequest.DryRun {
+		return nil
+	}
+	if err := matrixRequest.do("GET", "/_matrix/client/v3/account/whoami", nil, nil); err != nil {
+		return fmt.Errorf("checking the access token: %w", err)
+	}
+	if strings.HasPrefix(matrixRequest.Room, "#") {
+		var alias struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := matrixRequest.do("GET", "/_matrix/client/v3/directory/room/"+url.PathEscape(matrixRequest.Room), nil, &alias); err != nil {
+			return fmt.Errorf("resolving room %s: %w", matrixRequest.Room, err)
+		}
+		matrixRequest.Room = alias.RoomID
+	}
+	if err := matrixRequest.do("GET", "/_matrix/client/v3/rooms/"+url.PathEscape(matrixRequest.Room)+"/joined_members", nil, nil); err != nil {
+		return fmt.Errorf("checking access to room %s: %w", matrixRequest.Room, err)
+	}
+	return nil
+}
+
+func (matrixRequest *MatrixRequest) sendMatrixMessage(message string) error {
+	if matrixRequest.DryRun {
+		printDryRun("matrix room "+matrixRequest.Room, message)
+		return nil
+	}
+	txnID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return matrixRequest.do(
+		"PUT",
+		"/_matrix/client/v3/rooms/"+url.PathEscape(matrixRequest.Room)+"/send/m.room.message/"+txnID,
+		map[string]string{"msgtype": "m.text", "body": message},
+		nil,
+	)
+}
+
+func (matrixRequest *MatrixRequest) sendMatrixFlightNotification(avialableFlights AvialableFlights) error {
+	return matrixRequest.sendMatrixMessage(avialableFlights.message())
+}
+
+func (matrixRequest *MatrixRequest) sendMatrixRemovalNotification(removedFlights AvialableFlights) error {
+	return matrixRequest.sendMatrixMessage(removedFlights.removedMessage())
+}
+
+// TwilioAPIURL is the Twilio messages endpoint, formatted with the account SID.
+const TwilioAPIURL = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json"
+
+const (
+	// SMSMaxFlights is the number of soonest departures listed in an SMS.
+	SMSMaxFlights = 3
+	// SMSMaxMessageLength keeps an SMS within two GSM-7 segments.
+	SMSMaxMessageLength = 306
+)
+
+// summary lists the n soonest departures on one line each, for messages
+// with a tight length limit like SMS, and tells how many more there are.
+func (avialableFlights AvialableFlights) summary(title string, n int) string {
+	type entry struct {
+		route  string
+		flight AvialableFlight
+	}
+	var entries []entry
+	for _, key := range avialableFlights.keys() {
+		route, _, _ := parseFlightKey(key)
+		for _, flight := range avialableFlights[key] {
+			entries = append(entries, entry{route, flight})
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b entry) int {
+		return a.flight.DepartureDate.Compare(b.flight.DepartureDate)
+	})
+
+	summary := title
+	for _, entry := range entries[:min(n, len(entries))] {
+		summary += fmt.Sprintf("\n%s %s", entry.route, entry.flight.DepartureDate.In(Timezone).Format(DateFormat+" "+shortTimeFormat()))
+		if price := entry.flight.cheapestPrice(); price != nil {
+			summary += " " + price.String()
+		}
+	}
+	if len(entries) > n {
+		summary += fmt.Sprintf("\n+%d more", len(entries)-n)
+	}
+	return summary
+}
+
+type TwilioRequest struct {
+	Client *http.Client
+	SID    string
+	Token  string
+	From   string
+	To     []string
+	DryRun bool
+}
+
+func (twilioRequest *TwilioRequest) sendTwilioMessage(message string) error {
+	if runes := []rune(message); len(runes) > SMSMaxMessageLength {
+		message = string(runes[:SMSMaxMessageLength-3]) + "..."
+	}
+	if twilioRequest.DryRun {
+		printDryRun("sms "+strings.Join(twilioRequest.To, ", "), message)
+		return nil
+	}
+	var errs []error
+	for _, to := range twilioRequest.To {
+		if err := twilioRequest.sendTwilioSMS(to, message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (twilioRequest *TwilioRequest) sendTwilioSMS(to, message string) error {
+	form := url.Values{
+		"From": {twilioRequest.From},
+		"To":   {to},
+		"Body": {message},
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf(TwilioAPIURL, twilioRequest.SID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(twilioRequest.SID, twilioRequest.Token)
+
+	resp, err := twilioRequest.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errorResponse struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errorResponse)
+		return fmt.Errorf("error: twilio send sms to %s status code: %d, code: %d, message: %s", to, resp.StatusCode, errorResponse.Code, errorResponse.Message)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (twilioRequest *TwilioRequest) sendTwilioFlightNotification(avialableFlights AvialableFlights) error {
+	if len(avialableFlights) == 0 {
+		return nil
+	}
+	return twilioRequest.sendTwilioMessage(avialableFlights.summary(InstanceName+" Flights", SMSMaxFlights))
+}
+
+func (twilioRequest *TwilioRequest) sendTwilioRemovalNotification(removedFlights AvialableFlights) error {
+	return twilioRequest.sendTwilioMessage(removedFlights.summary(InstanceName+" Flights No Longer Available", SMSMaxFlights))
+}
+
+type EmailRequest struct {
+	Host   string
+	Port   uint
+	User   string
+	Pass   string
+	From   string
+	To     []string
+	DryRun bool
+}
+
+func (emailRequest *EmailRequest) sendEmailMessage(subject, body string) error {
+	if emailRequest.DryRun {
+		printDryRun("email to "+strings.Join(emailRequest.To, ", "), "Subject: "+subject+"\n\n"+body)
+		return nil
+	}
+	var auth smtp.Auth
+	if emailRequest.User != "" {
+		auth = smtp.PlainAuth("", emailRequest.User, emailRequest.Pass, emailRequest.Host)
+	}
+	message := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		emailRequest.From,
+		strings.Join(emailRequest.To, ", "),
+		subject,
+		strings.ReplaceAll(body, "\n", "\r\n"),
+	)
+	return smtp.SendMail(
+		fmt.Sprintf("%s:%d", emailRequest.Host, emailRequest.Port),
+		auth,
+		emailRequest.From,
+		emailRequest.To,
+		[]byte(message),
+	)
+}
+
+func (emailRequest *EmailRequest) sendEmailFlightNotification(avialableFlights AvialableFlights) error {
+	return emailRequest.sendEmailMessage(InstanceName+" Flights", avialableFlights.message())
+}
+
+func (emailRequest *EmailRequest) sendEmailRemovalNotification(removedFlights AvialableFlights) error {
+	return emailRequest.sendEmailMessage(InstanceName+" Flights No Longer Available", removedFlights.removedMessage())
+}
+
+type WebhookRequest struct {
+	Client *http.Client
+	URL    string
+	DryRun bool
+}
+
+type WebhookFlight struct {
+	DepartureDate time.Time   `json:"departure_date"`
+	Economy       bool        `json:"economy"`
+	Business      bool        `json:"business"`
+	EconomyPrice  *azal.Price `json:"economy_price,omitempty"`
+	BusinessPrice *azal.Price `json:"business_price,omitempty"`
+	Seats         int         `json:"seats,omitempty"`
+	ArrivalDate   *time.Time  `json:"arrival_date,omitempty"`
+	ID            string      `json:"id,omitempty"`
+	New           bool        `json:"new"`
+	Fares         []Fare      `json:"fares,omitempty"`
+	SoldOut       bool        `json:"sold_out,omitempty"`
+}
+
+type WebhookDay struct {
+	Route   string          `json:"route"`
+	Day     string          `json:"day"`
+	Return  bool            `json:"return"`
+	Flights []WebhookFlight `json:"flights"`
+}
+
+type WebhookPayload struct {
+	// Event is "available" for the current flights and "removed" for the
+	// departures that disappeared since the previous check.
+	Event string `json:"event"`
+	// Instance is the --instance-name.
+	Instance string       `json:"instance"`
+	Days     []WebhookDay `json:"days"`
+}
+
+func newWebhookPayload(event string, avialableFlights AvialableFlights) WebhookPayload {
+	payload := WebhookPayload{Event: event, Instance: InstanceName, Days: []WebhookDay{}}
+	for _, key := range avialableFlights.keys() {
+		route, day, isReturn := parseFlightKey(key)
+		webhookDay := WebhookDay{Route: route, Day: day, Return: isReturn}
+		for _, flight := range avialableFlights[key] {
+			webhookFlight := WebhookFlight{
+				DepartureDate: flight.DepartureDate,
+				Economy:       flight.Economy,
+				Business:      flight.Business,
+				EconomyPrice:  flight.EconomyPrice,
+				BusinessPrice: flight.BusinessPrice,
+				Seats:         flight.Seats,
+				ID:            flight.ID,
+				New:           flight.New,
+				Fares:         flight.Fares,
+				SoldOut:       flight.SoldOut,
+			}
+			if !flight.ArrivalDate.IsZero() {
+				webhookFlight.ArrivalDate = &flight.ArrivalDate
+			}
+			webhookDay.Flights = append(webhookDay.Flights, webhookFlight)
+		}
+		payload.Days = append(payload.Days, webhookDay)
+	}
+	return payload
+}
+
+// PollOutput is the line --output-json prints to stdout after each check.
+type PollOutput struct {
+	Time time.Time    `json:"time"`
+	Days []WebhookDay `json:"days"`
+}
+
+func printPollOutput(avialableFlights AvialableFlights) error {
+	return json.NewEncoder(os.Stdout).Encode(PollOutput{
+		Time: time.Now(),
+		Days: newWebhookPayload("", avialableFlights).Days,
+	})
+}
+
+func (webhookRequest *WebhookRequest) sendWebhookFlightNotification(avialableFlights AvialableFlights) error {
+	return webhookRequest.sendWebhookPayload(newWebhookPayload("available", avialableFlights))
+}
+
+func (webhookRequest *WebhookRequest) sendWebhookRemovalNotification(removedFlights AvialableFlights) error {
+	return webhookRequest.sendWebhookPayload(newWebhookPayload("removed", removedFlights))
+}
+
+func (webhookRequest *WebhookRequest) sendWebhookPayload(payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if webhookRequest.DryRun {
+		printDryRun("webhook "+webhookRequest.URL, string(body))
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", webhookRequest.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookRequest.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error: webhook status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+//go:embed airports.txt
+var airportsFile string
+
+type Airport struct {
+	Name     string
+	Timezone *time.Location
+}
+
+// knownAirports parses the bundled airports list into a code -> airport map.
+func knownAirports() map[string]Airport {
+	airports := make(map[string]Airport)
+	scanner := bufio.NewScanner(strings.NewReader(airportsFile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		code, rest, _ := strings.Cut(line, " ")
+		timezone, name, _ := strings.Cut(rest, " ")
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			location = azal.Timezone
+		}
+		airports[code] = Airport{Name: name, Timezone: location}
+	}
+	return airports
+}
+
+var airports = knownAirports()
+
+// airportTime reads a time the API gave without an offset in the timezone of
+// the airport, so that durations across timezones come out right. Times with
+// an offset and unknown airports are kept as parsed.
+func airportTime(responseTime azal.ResponseTime, code string) time.Time {
+	airport, ok := airports[code]
+	if !ok || !responseTime.Local || responseTime.IsZero() {
+		return responseTime.Time
+	}
+	t := responseTime.Time
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), airport.Timezone)
+}
+
+type Route struct {
+	From string
+	To   string
+}
+
+func (route Route) String() string {
+	return route.From + "-" + route.To
+}
+
+type UserInput struct {
+	FirstDate              time.Time
+	LastDate               time.Time
+	Dates                  []string
+	ReturnDate             time.Time
+	ReturnRoute            *Route
+	Routes                 []Route
+	TelegramBotKey         string
+	TelegramChatIDs        []string
+	DiscordWebhook         string
+	SlackWebhook           string
+	PushoverToken          string
+	PushoverUser           string
+	NtfyURL                string
+	NtfyToken              string
+	MatrixHomeserver       string
+	MatrixToken            string
+	MatrixRoom             string
+	SMTPHost               string
+	SMTPPort               uint
+	SMTPUser               string
+	SMTPPass               string
+	EmailFrom              string
+	EmailTo                []string
+	TwilioSID              string
+	TwilioToken            string
+	TwilioFrom             string
+	SMSTo                  []string
+	WebhookURL             string
+	WebhookTimeout         time.Duration
+	PrimaryBackend         string
+	FallbackBackend        string
+	RouteNotifications     []RouteNotification
+	RouteIntervals         map[string]time.Duration
+	StateFile              string
+	NoStartNotification    bool
+	DailyStartNotification bool
+	DumpResponsesDir       string
+	Trace                  bool
+	CSVFile                string
+	MetricsAddr            string
+	HealthAddr             string
+	LogFormat              string
+	LogLevel               string
+	LogFile                string
+	LogMaxSize             uint
+	LogBackups             uint
+	NoColor                bool
+	NotifyErrors           bool
+	NotifyRemovals         bool
+	NotifyCooldown         time.Duration
+	SummaryInterval        time.Duration
+	LatencyStatsInterval   time.Duration
+	MaxNotificationsPerDay uint
+	Proxy                  *url.URL
+	DisableHTTP2           bool
+	DisableKeepAlive       bool
+	APIURL                 string
+	APIAuthorization       string
+	TelegramAPIURL         string
+	Once                   bool
+	ExitOnFirstMatch       bool
+	WarmupNoNotify         bool
+	FailFast               bool
+	DryRun                 bool
+	OutputJSON             bool
+	TestNotify             bool
+	// Check is set by the check command: validate the input and exit without running.
+	Check bool
+	// TestNotifyCommand is set by the test-notify command: test every backend and exit.
+	TestNotifyCommand  bool
+	PrintDeeplink      bool
+	MaxRetries         uint
+	MaxRequests        uint
+	BackoffAfter       uint
+	MaxBackoffInterval time.Duration
+	BreakerThreshold   uint
+	BreakerWindow      time.Duration
+	BreakerCooldown    time.Duration
+	Concurrency        uint
+	RateLimit          float64
+	RandomUserAgent    bool
+	Seed               uint64
+	Adults             uint
+	Children           uint
+	Infants            uint
+	InfantsWithSeat    uint
+	MaxPrice           float64
+	MinSeats           uint
+	MinAdvanceDays     uint
+	MaxAdvanceDays     uint
+	Currency           string
+	Locale             string
+	DisplayCurrency    string
+	FXURL              string
+	CabinClass         string
+	AllFares           bool
+	IncludeSoldOut     bool
+	RepetInterval      time.Duration
+	Jitter             uint
+	RequestTimeout     time.Duration
+	QuietHours         *QuietHours
+	Deadline           time.Time
+}
+
+// notificationBackends lists the configured notification backends for the check command.
+func (userInput *UserInput) notificationBackends() []string {
+	var backends []string
+	if userInput.TelegramBotKey != "" {
+		backends = append(backends, fmt.Sprintf("telegram (%d chat(s))", len(userInput.TelegramChatIDs)))
+	}
+	if userInput.DiscordWebhook != "" {
+		backends = append(backends, "discord")
+	}
+	if userInput.SlackWebhook != "" {
+		backends = append(backends, "slack")
+	}
+	if userInput.PushoverToken != "" {
+		backends = append(backends, "pushover")
+	}
+	if userInput.NtfyURL != "" {
+		backends = append(backends, "ntfy")
+	}
+	if userInput.MatrixHomeserver != "" {
+		backends = append(backends, "matrix")
+	}
+	if userInput.SMTPHost != "" {
+		backends = append(backends, fmt.Sprintf("email (%d recipient(s))", len(userInput.EmailTo)))
+	}
+	if userInput.TwilioSID != "" {
+		backends = append(backends, fmt.Sprintf("sms (%d recipient(s))", len(userInput.SMSTo)))
+	}
+	if userInput.WebhookURL != "" {
+		backends = append(backends, "webhook")
+	}
+	for _, routeNotification := range userInput.RouteNotifications {
+		backends = append(backends, fmt.Sprintf("%s (own targets)", routeNotification.Route))
+	}
+	if len(backends) == 0 {
+		backends = append(backends, "none (log only)")
+	}
+	return backends
+}
+
+type ConfigFile struct {
+	FirstDate              string `yaml:"first-date"`
+	Dates                  string `yaml:"dates"`
+	LastDate               string `yaml:"last-date"`
+	ReturnDate             string `yaml:"return-date"`
+	ReturnFrom             string `yaml:"return-from"`
+	ReturnTo               string `yaml:"return-to"`
+	From                   string `yaml:"from"`
+	To                     string `yaml:"to"`
+	TelegramBotKey         string `yaml:"telegram-bot-key"`
+	TelegramChatID         string `yaml:"telegram-chat-id"`
+	DiscordWebhook         string `yaml:"discord-webhook"`
+	SlackWebhook           string `yaml:"slack-webhook"`
+	PushoverToken          string `yaml:"pushover-token"`
+	PushoverUser           string `yaml:"pushover-user"`
+	NtfyURL                string `yaml:"ntfy-url"`
+	NtfyToken              string `yaml:"ntfy-token"`
+	MatrixHomeserver       string `yaml:"matrix-homeserver"`
+	MatrixToken            string `yaml:"matrix-token"`
+	MatrixRoom             string `yaml:"matrix-room"`
+	SMTPHost               string `yaml:"smtp-host"`
+	SMTPPort               string `yaml:"smtp-port"`
+	SMTPUser               string `yaml:"smtp-user"`
+	SMTPPass               string `yaml:"smtp-pass"`
+	EmailFrom              string `yaml:"email-from"`
+	EmailTo                string `yaml:"email-to"`
+	TwilioSID              string `yaml:"twilio-sid"`
+	TwilioToken            string `yaml:"twilio-token"`
+	TwilioFrom             string `yaml:"twilio-from"`
+	SMSTo                  string `yaml:"sms-to"`
+	WebhookURL             string `yaml:"webhook-url"`
+	WebhookTimeout         string `yaml:"webhook-timeout"`
+	PrimaryBackend         string `yaml:"primary-backend"`
+	FallbackBackend        string `yaml:"fallback-backend"`
+	LogFormat              string `yaml:"log-format"`
+	LogLevel               string `yaml:"log-level"`
+	LogFile                string `yaml:"log-file"`
+	LogMaxSize             string `yaml:"log-max-size"`
+	LogBackups             string `yaml:"log-backups"`
+	Verbose                string `yaml:"verbose"`
+	NoColor                string `yaml:"no-color"`
+	StrictCodes            string `yaml:"strict-codes"`
+	NotifyErrors           string `yaml:"notify-errors"`
+	NotifyRemovals         string `yaml:"notify-removals"`
+	NotifyCooldown         string `yaml:"notify-cooldown"`
+	SummaryInterval        string `yaml:"summary-interval"`
+	LatencyStatsInterval   string `yaml:"latency-stats-interval"`
+	MaxNotificationsPerDay string `yaml:"max-notifications-per-day"`
+	Proxy                  string `yaml:"proxy"`
+	DisableHTTP2           string `yaml:"disable-http2"`
+	DisableKeepAlive       string `yaml:"disable-keepalive"`
+	APIURL                 string `yaml:"api-url"`
+	TelegramAPIURL         string `yaml:"telegram-api-url"`
+	APIAuthValue           string `yaml:"api-auth-value"`
+	BearerToken            string `yaml:"bearer-token"`
+	StateFile              string `yaml:"state-file"`
+	NoStartNotification    string `yaml:"no-start-notification"`
+	DailyStartNotification string `yaml:"daily-start-notification"`
+	DumpResponses          string `yaml:"dump-responses"`
+	Trace                  string `yaml:"trace"`
+	CSVFile                string `yaml:"csv-file"`
+	MetricsAddr            string `yaml:"metrics-addr"`
+	HealthAddr             string `yaml:"health-addr"`
+	Once                   string `yaml:"once"`
+	ExitOnFirstMatch       string `yaml:"exit-on-first-match"`
+	WarmupNoNotify         string `yaml:"warmup-no-notify"`
+	FailFast               string `yaml:"fail-fast"`
+	DryRun                 string `yaml:"dry-run"`
+	OutputJSON             string `yaml:"output-json"`
+	TestNotify             string `yaml:"test-notify"`
+	MessageTemplate        string `yaml:"message-template"`
+	Compact                string `yaml:"compact"`
+	InstanceName           string `yaml:"instance-name"`
+	DateFormat             string `yaml:"date-format"`
+	TimeFormat             string `yaml:"time-format"`
+	BookingURLTemplate     string `yaml:"booking-url-template"`
+	MaxRetries             string `yaml:"max-retries"`
+	MaxRequests            string `yaml:"max-requests"`
+	BackoffAfter           string `yaml:"backoff-after"`
+	MaxBackoffInterval     string `yaml:"max-backoff-interval"`
+	BreakerThreshold       string `yaml:"breaker-threshold"`
+	BreakerWindow          string `yaml:"breaker-window"`
+	BreakerCooldown        string `yaml:"breaker-cooldown"`
+	Concurrency            string `yaml:"concurrency"`
+	RateLimit              string `yaml:"rate-limit"`
+	RandomUserAgent        string `yaml:"random-user-agent"`
+	Seed                   string `yaml:"seed"`
+	Adults                 string `yaml:"adults"`
+	Children               string `yaml:"children"`
+	Infants                string `yaml:"infants"`
+	InfantsWithSeat        string `yaml:"infants-with-seat"`
+	MaxPrice               string `yaml:"max-price"`
+	MinSeats               string `yaml:"min-seats"`
+	MinAdvanceDays         string `yaml:"min-advance-days"`
+	MaxAdvanceDays         string `yaml:"max-advance-days"`
+	Currency               string `yaml:"currency"`
+	Locale                 string `yaml:"locale"`
+	DisplayCurrency        string `yaml:"display-currency"`
+	FXURL                  string `yaml:"fx-url"`
+	CabinClass             string `yaml:"cabin-class"`
+	AllFares               string `yaml:"all-fares"`
+	IncludeSoldOut         string `yaml:"include-sold-out"`
+	RepetInterval          string `yaml:"repet-interval"`
+	Jitter                 string `yaml:"jitter"`
+	RequestTimeout         string `yaml:"request-timeout"`
+	QuietHours             string `yaml:"quiet-hours"`
+	Duration               string `yaml:"duration"`
+	Until                  string `yaml:"until"`
+	Timezone               string `yaml:"timezone"`
+	// RouteNotifications has no flag, it can only be set in the config file.
+	RouteNotifications []RouteNotification `yaml:"route-notifications"`
+	// RouteIntervals gives routes their own repet-interval, like "NAJ-GYD: 1m"; config file only.
+	RouteIntervals map[string]string `yaml:"route-intervals"`
+}
+
+// RouteNotification sends the flights of one route to its own targets instead of the global backends.
+type RouteNotification struct {
+	Route          string   `yaml:"route"`
+	TelegramChatID []string `yaml:"telegram-chat-id"`
+	DiscordWebhook string   `yaml:"discord-webhook"`
+	SlackWebhook   string   `yaml:"slack-webhook"`
+	WebhookURL     string   `yaml:"webhook-url"`
+}
+
+func loadConfigFile(path string) (*ConfigFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	configFile := &ConfigFile{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(configFile); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+
+	for key, value := range map[string]string{
+		"first-date": configFile.FirstDate,
+		"last-date":  configFile.LastDate,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, _, err := parseDate(value); err != nil {
+			return nil, fmt.Errorf("config %s: %s: %v", path, key, err)
+		}
+	}
+	if configFile.ReturnDate != "" {
+		if _, err := time.Parse("2006-01-02", configFile.ReturnDate); err != nil {
+			return nil, fmt.Errorf("config %s: return-date: %v", path, err)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, routeNotification := range configFile.RouteNotifications {
+		routeNotification.Route = strings.ToUpper(strings.TrimSpace(routeNotification.Route))
+		from, to, ok := strings.Cut(routeNotification.Route, "-")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("config %s: route-notifications: invalid route %q, expected FROM-TO", path, routeNotification.Route)
+		}
+		if seen[routeNotification.Route] {
+			return nil, fmt.Errorf("config %s: route-notifications: %s is listed more than once", path, routeNotification.Route)
+		}
+		seen[routeNotification.Route] = true
+		if len(routeNotification.TelegramChatID) == 0 && routeNotification.DiscordWebhook == "" &&
+			routeNotification.SlackWebhook == "" && routeNotification.WebhookURL == "" {
+			return nil, fmt.Errorf("config %s: route-notifications: %s has no notification target", path, routeNotification.Route)
+		}
+		configFile.RouteNotifications[i] = routeNotification
+	}
+	routeIntervals := make(map[string]string, len(configFile.RouteIntervals))
+	for route, value := range configFile.RouteIntervals {
+		route = strings.ToUpper(strings.TrimSpace(route))
+		from, to, ok := strings.Cut(route, "-")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("config %s: route-intervals: invalid route %q, expected FROM-TO", path, route)
+		}
+		if _, ok := routeIntervals[route]; ok {
+			return nil, fmt.Errorf("config %s: route-intervals: %s is listed more than once", path, route)
+		}
+		interval, err := parseInterval(value)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: route-intervals: %s: %v", path, route, err)
+		}
+		if interval < MinRepetInterval {
+			return nil, fmt.Errorf("config %s: route-intervals: %s should be at least %s", path, route, MinRepetInterval)
+		}
+		routeIntervals[route] = value
+	}
+	configFile.RouteIntervals = routeIntervals
+	return configFile, nil
+}
+
+// setToFlags sets every non-empty config value to the flag named by its yaml tag,
+// unless that flag was already given on the command line.
+func (configFile *ConfigFile) setToFlags(flags *pflag.FlagSet) error {
+	t := reflect.TypeOf(*configFile)
+	v := reflect.ValueOf(configFile).Elem()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type.Kind() != reflect.String {
+			continue
+		}
+		name := field.Tag.Get("yaml")
+		value := v.Field(i).String()
+		if value == "" || flags.Changed(name) {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// exampleConfigValue renders a flag default as a YAML value. Empty defaults and
+// the ones only described in the usage (like "(default random)") are left empty.
+func exampleConfigValue(flag *pflag.Flag) string {
+	value := flag.DefValue
+	if value == "[]" || strings.Contains(flag.Usage, "(default ") {
+		value = ""
+	}
+	if value == "" {
+		return `""`
+	}
+	if regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/+-]*$`).MatchString(value) {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+// writeExampleConfig writes a config file with every key commented out at its
+// default, each under the usage of its flag, plus examples of the config only keys.
+// An existing file is only overwritten with force.
+func writeExampleConfig(path string, flags *pflag.FlagSet, force bool) error {
+	var b strings.Builder
+	b.WriteString("# Azal Bot config file, see azal-bot --help for the flags.\n")
+	b.WriteString("# Uncomment and change the keys you need; flags given on the command line override them.\n")
+
+	t := reflect.TypeOf(ConfigFile{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type.Kind() != reflect.String {
+			continue
+		}
+		name := field.Tag.Get("yaml")
+		flag := flags.Lookup(name)
+		if flag == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "\n# %s\n# %s: %s\n", flag.Usage, name, exampleConfigValue(flag))
+	}
+	b.WriteString(`
+# Send the flights of a route to its own targets instead of the global backends.
+# route-notifications:
+#   - route: BAK-IST
+#     telegram-chat-id: [chat-id]
+#     discord-webhook: ""
+#     slack-webhook: ""
+#     webhook-url: ""
+
+# Give routes their own repet-interval.
+# route-intervals:
+#   GYD-IST: 1h
+`)
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+		}
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type BotConfig struct {
+	FirstDate  time.Time
+	LastDate   time.Time
+	ReturnDate time.Time
+	// ReturnRoute is set when the return flight doesn't simply reverse the outbound route.
+	ReturnRoute            *Route
+	Routes                 []Route
+	days                   []string
+	StateFile              string
+	NotifyErrors           bool
+	NotifyCooldown         time.Duration
+	SummaryInterval        time.Duration
+	LatencyStatsInterval   time.Duration
+	MaxNotificationsPerDay uint
+	Proxy                  *url.URL
+	DisableHTTP2           bool
+	DisableKeepAlive       bool
+	APIURL                 string
+	APIAuthorization       string
+	Once                   bool
+	ExitOnFirstMatch       bool
+	WarmupNoNotify         bool
+	FailFast               bool
+	OutputJSON             bool
+	MaxRetries             uint
+	BackoffAfter           uint
+	MaxBackoffInterval     time.Duration
+	BreakerThreshold       uint
+	BreakerWindow          time.Duration
+	BreakerCooldown        time.Duration
+	Concurrency            uint
+	Adults                 uint
+	Children               uint
+	Infants                uint
+	InfantsWithSeat        uint
+	MaxPrice               float64
+	MinSeats               uint
+	MinAdvanceDays         uint
+	MaxAdvanceDays         uint
+	Currency               string
+	Locale                 string
+	CabinClass             string
+	AllFares               bool
+	IncludeSoldOut         bool
+	RepetInterval          time.Duration
+	RouteIntervals         map[string]time.Duration
+	Jitter                 uint
+	RequestTimeout         time.Duration
+	QuietHours             *QuietHours
+	// Deadline, if set, stops the bot after the poll running when it passes.
+	Deadline time.Time
+}
+
+// queryConfigs returns the search query of each route, without the departure date.
+func (botConfig *BotConfig) queryConfigs() []azal.QueryConfig {
+	queryConfs := make([]azal.QueryConfig, len(botConfig.Routes))
+	for i, route := range botConfig.Routes {
+		queryConfs[i] = azal.QueryConfig{
+			From:        route.From,
+			To:          route.To,
+			AdultCount:  strconv.FormatUint(uint64(botConfig.Adults), 10),
+			ChildCount:  strconv.FormatUint(uint64(botConfig.Children), 10),
+			InfantCount: strconv.FormatUint(uint64(botConfig.Infants), 10),
+			Currency:    botConfig.Currency,
+			Lang:        botConfig.Locale,
+		}
+		if botConfig.InfantsWithSeat > 0 {
+			queryConfs[i].InfantWithSeatCount = strconv.FormatUint(uint64(botConfig.InfantsWithSeat), 10)
+		}
+		if !botConfig.ReturnDate.IsZero() && botConfig.ReturnRoute == nil {
+			queryConfs[i].TripType = "RT"
+			queryConfs[i].ReturnDate = botConfig.ReturnDate.Format("2006-01-02")
+		}
+		queryConfs[i].SetDefaults()
+	}
+	return queryConfs
+}
+
+// tooExpensive reports whether the flight's cheapest known fare exceeds MaxPrice.
+// Flights without a known fare are never filtered out.
+func (botConfig *BotConfig) tooExpensive(flight AvialableFlight) bool {
+	if botConfig.MaxPrice <= 0 {
+		return false
+	}
+	price := flight.cheapestPrice()
+	return price != nil && price.Amount > botConfig.MaxPrice
+}
+
+// outsideAdvanceWindow reports whether the flight departs sooner than MinAdvanceDays
+// or later than MaxAdvanceDays from now. A zero bound is not checked.
+func (botConfig *BotConfig) outsideAdvanceWindow(departureDate time.Time) bool {
+	now := time.Now()
+	if botConfig.MinAdvanceDays > 0 && departureDate.Before(now.AddDate(0, 0, int(botConfig.MinAdvanceDays))) {
+		return true
+	}
+	return botConfig.MaxAdvanceDays > 0 && departureDate.After(now.AddDate(0, 0, int(botConfig.MaxAdvanceDays)))
+}
+
+// wrongCabinClass reports whether the flight isn't offered in CabinClass.
+// Otherwise it drops the fare of the other class, so the notification and
+// the MaxPrice filter only consider the requested one.
+func (botConfig *BotConfig) wrongCabinClass(flight *AvialableFlight) bool {
+	switch botConfig.CabinClass {
+	case "economy":
+		flight.Business, flight.BusinessPrice = false, nil
+		return !flight.Economy
+	case "business":
+		flight.Economy, flight.EconomyPrice = false, nil
+		return !flight.Business
+	}
+	return false
+}
+
+// tooFewSeats reports whether the flight has fewer seats left than MinSeats.
+// Flights without a known seat count are never filtered out.
+func (botConfig *BotConfig) tooFewSeats(flight AvialableFlight) bool {
+	return flight.Seats > 0 && flight.Seats < int(botConfig.MinSeats)
+}
+
+// collectFlights turns the options of a search into the flights to notify,
+// dropping and logging the ones the filters reject. The flights of the outbound
+// leg must also depart between FirstDate and LastDate and within the advance
+// days; a return leg covers its whole day.
+func (botConfig *BotConfig) collectFlights(data *azal.SuccessResponse, route Route, queryConf *azal.QueryConfig, options []azal.ResponseOption, fields LogFields, isReturn bool) []AvialableFlight {
+	// title starts a message, name is the flight in the middle of one and leg
+	// is put before the route, so the outbound messages don't repeat "flight".
+	title, name, leg := "Flight", "flight", ""
+	if isReturn {
+		title, name, leg = "Return flight", "return flight", "return flight "
+	}
+	var flights []AvialableFlight
+	for _, option := range options {
+		if !isReturn {
+			departureDate := option.Route.DepartureDate.Time
+			if departureDate.Before(botConfig.FirstDate) || departureDate.After(botConfig.LastDate) {
+				fields.Event = "no_flights"
+				logger.Debug(fields, "No flights available for ", route, " ", formatDeparture(departureDate))
+				continue
+			}
+			if botConfig.outsideAdvanceWindow(departureDate) {
+				fields.Event = "outside_advance_window"
+				logger.Debug(fields, "Flight outside the advance days for ", route, " ", formatDeparture(departureDate))
+				continue
+			}
+		}
+		flight := newAvialableFlight(data, route, option)
+		flight.BookingURL = flightBookingURL(queryConf)
+		if botConfig.AllFares {
+			flight.Fares = optionFares(data, option)
+		}
+		if !option.Available {
+			if !botConfig.IncludeSoldOut {
+				fields.Event = "sold_out"
+				logger.Debug(fields, title, " sold out for ", route, " ", formatDeparture(flight.DepartureDate))
+				continue
+			}
+			flight.SoldOut = true
+			flights = append(flights, flight)
+			fields.Event = "flight_sold_out"
+			logger.Info(fields, "Sold out ", name, " for ", route, " ", formatDeparture(flight.DepartureDate), flight.arrival())
+			continue
+		}
+		if botConfig.wrongCabinClass(&flight) {
+			fields.Event = "wrong_cabin_class"
+			logger.Warn(fields, "No ", botConfig.CabinClass, " class for ", leg, route, " ", formatDeparture(flight.DepartureDate), flight.arrival())
+			continue
+		}
+		if botConfig.tooExpensive(flight) {
+			fields.Event = "too_expensive"
+			logger.Warn(fields, title, " too expensive for ", route, " ", formatDeparture(flight.DepartureDate), flight.arrival(), " ("+flight.classes()+")")
+			continue
+		}
+		if botConfig.tooFewSeats(flight) {
+			fields.Event = "too_few_seats"
+			logger.Warn(fields, "Too few seats for ", leg, route, " ", formatDeparture(flight.DepartureDate), flight.arrival(), " ("+flight.classes()+")")
+			continue
+		}
+		flights = append(flights, flight)
+		metrics.FlightsFound.Inc()
+		fields.Event = "flight_available"
+		logger.Info(fields, title, " available for ", route, " ", formatDeparture(flight.DepartureDate), flight.arrival(), " ("+flight.classes()+")")
+		logger.Debug(fields, title, " ID for ", route, " ", formatDeparture(flight.DepartureDate), ": ", flight.shortID())
+	}
+	return flights
+}
+
+// Timezone is used to interpret the user supplied dates and to display the flight
+// times. The API times are read in their airport's timezone (see airportTime) and
+// are converted with In(Timezone) where they are formatted, the departure and the
+// arrival alike. It starts as azal.Timezone, the --timezone default.
+var Timezone = azal.Timezone
+
+// uniqueOptions drops the options the API repeats in one response, matched by
+// route ID like newAvialableFlight, or by the departure time when there is no ID.
+// The first of the repeats is kept, and the number of dropped ones is returned.
+func uniqueOptions(options []azal.ResponseOption) ([]azal.ResponseOption, int) {
+	seen := make(map[string]bool, len(options))
+	unique := make([]azal.ResponseOption, 0, len(options))
+	for _, option := range options {
+		id := cmp.Or(option.Route.ID, option.ID)
+		if id == "" {
+			id = option.Route.DepartureDate.Format(time.RFC3339)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, option)
+	}
+	return unique, len(options) - len(unique)
+}
+
+func newAvialableFlight(successResponse *azal.SuccessResponse, route Route, option azal.ResponseOption) AvialableFlight {
+	return AvialableFlight{
+		Economy:       option.CheapestEconomySolutionId != "",
+		Business:      option.CheapestBusinessSolutionId != "",
+		EconomyPrice:  successResponse.SolutionPrice(option.CheapestEconomySolutionId),
+		BusinessPrice: successResponse.SolutionPrice(option.CheapestBusinessSolutionId),
+		Seats:         option.AvailableSeats,
+		DepartureDate: airportTime(option.Route.DepartureDate, route.From),
+		ArrivalDate:   airportTime(option.Route.ArrivalDate, route.To),
+		ID:            cmp.Or(option.Route.ID, option.ID),
+	}
+}
+
+// UserAgents is the pool --random-user-agent picks from.
+var UserAgents = []string{
+	azal.DefaultUserAgent,
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.0.0",
+}
+
+// UserAgentRotator picks a User-Agent from UserAgents for each request.
+// The same seed gives the same sequence; a nil UserAgentRotator keeps the fixed one.
+type UserAgentRotator struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newUserAgentRotator(seed uint64) *UserAgentRotator {
+	return &UserAgentRotator{rand: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// userAgentRotator rotates the User-Agent of the API requests, if --random-user-agent is set.
+var userAgentRotator *UserAgentRotator
+
+func (userAgentRotator *UserAgentRotator) next() string {
+	userAgentRotator.mu.Lock()
+	defer userAgentRotator.mu.Unlock()
+	return UserAgents[userAgentRotator.rand.IntN(len(UserAgents))]
+}
+
+func sendRequest(ctx context.Context, client *http.Client, apiURL string, queryConf *azal.QueryConfig, headerConf *azal.HeaderConfig) (*azal.SuccessResponse, error) {
+	req, err := azal.NewRequest(ctx, apiURL, queryConf, headerConf)
+	if err != nil {
+		return nil, err
+	}
+	if userAgentRotator != nil {
+		req.Header.Set("User-Agent", userAgentRotator.next())
+	}
+
+	if !requestBudget.take() {
+		return nil, ErrorBudgetExhausted
+	}
+	if err := rateLimit.wait(ctx); err != nil {
+		return nil, err
+	}
+	if err := requestLimiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	metrics.Requests.Inc()
+	if Trace {
+		traceRequest(req)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	metrics.RequestDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		if Trace {
+			logger.Info(LogFields{Event: "trace_response"}, "<- ", req.Method, " ", redactURL(req.URL), ": ", err)
+		}
+		return nil, err
+	}
+	latencyStats.record(time.Since(start))
+	defer resp.Body.Close()
+
+	respBody, err := azal.ReadBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	if Trace {
+		traceResponse(req, resp, respBody)
+	}
+	if DumpResponsesDir != "" {
+		dumpResponse(queryConf, resp.StatusCode, respBody)
+	}
+	data, err := azal.ParseResponse(resp, respBody)
+	var statusCodeError *azal.StatusCodeError
+	if errors.As(err, &statusCodeError) && statusCodeError.StatusCode == http.StatusTooManyRequests {
+		rateLimit.hit(statusCodeError.RetryAfter)
+	}
+	if err == nil && data.Search.OptionSets == nil {
+		logger.Debug(
+			LogFields{Event: "unexpected_response", Route: Route{From: queryConf.From, To: queryConf.To}.String(), Day: queryConf.DepartureDate},
+			"Response has no optionSets, treating it as no flights: ", string(respBody),
+		)
+	}
+	return data, err
+}
+
+// DumpResponsesDir is the directory the raw API response bodies are written to, if set.
+var DumpResponsesDir string
+
+// dumpResponse writes a raw response body to DumpResponsesDir.
+// A failed write is only logged, it never fails the request.
+func dumpResponse(queryConf *azal.QueryConfig, statusCode int, body []byte) {
+	name := fmt.Sprintf(
+		"%s_%s-%s_%s_%d.json",
+		time.Now().Format("20060102T150405.000"), queryConf.From, queryConf.To, queryConf.DepartureDate, statusCode,
+	)
+	if err := os.WriteFile(filepath.Join(DumpResponsesDir, name), body, 0o644); err != nil {
+		logger.Warn(LogFields{Event: "dump_response_failed"}, err.Error())
+	}
+}
+
+// Trace logs the requests and the raw responses, set by --trace.
+var Trace bool
+
+// TraceRedactedHeaders are the request headers whose values never appear in the trace.
+var TraceRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// telegramBotPath matches the bot key in the path of a Bot API URL.
+var telegramBotPath = regexp.MustCompile(`/bot[^/]+`)
+
+// redactURL returns the URL with the Telegram bot key and any userinfo replaced.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.Path = telegramBotPath.ReplaceAllString(u.Path, "/botREDACTED")
+	redacted.RawPath = ""
+	if u.User != nil {
+		redacted.User = url.User("REDACTED")
+	}
+	return redacted.String()
+}
+
+// traceRequest logs the method, URL and headers of a request.
+func traceRequest(req *http.Request) {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "-> %s %s", req.Method, redactURL(req.URL))
+	for _, name := range names {
+		value := strings.Join(req.Header.Values(name), ", ")
+		if slices.Contains(TraceRedactedHeaders, http.CanonicalHeaderKey(name)) {
+			value = "REDACTED"
+		}
+		fmt.Fprintf(&b, "\n  %s: %s", name, value)
+	}
+	logger.Info(LogFields{Event: "trace_request"}, b.String())
+}
+
+// traceResponse logs the status and the body of the response to req.
+func traceResponse(req *http.Request, resp *http.Response, body []byte) {
+	logger.Info(
+		LogFields{Event: "trace_response"},
+		"<- ", req.Method, " ", redactURL(req.URL), ": ", resp.Status, "\n", string(body),
+	)
+}
+
+// isRetryable reports whether err is a connection error, a 429 or a 5xx response.
+// Business errors like no.flights.available are valid results and are never retried,
+// and neither is a request cancelled because the bot is stopping.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var urlError *url.Error
+	if errors.As(err, &urlError) {
+		return true
+	}
+	return errors.Is(err, azal.ErrorServerError) || errors.Is(err, azal.ErrorRateLimited)
+}
+
+// isUnrecoverable reports whether err is a failure that repeating the request
+// can't fix: a 4xx response rejecting the parameters or credentials, or an error
+// code the API doesn't explain. Network errors, 5xx and 429 responses are transient.
+func isUnrecoverable(err error) bool {
+	return errors.Is(err, azal.ErrorBadStatus) || errors.Is(err, azal.ErrorUnknown)
+}
+
+// sendRequestWithRetry retries sendRequest up to maxRetries times with exponential backoff and jitter.
+func sendRequestWithRetry(ctx context.Context, client *http.Client, apiURL string, queryConf *azal.QueryConfig, headerConf *azal.HeaderConfig, maxRetries uint) (*azal.SuccessResponse, error) {
+	delay := RetryBaseDelay
+	for attempt := uint(0); ; attempt++ {
+		data, err := sendRequest(ctx, client, apiURL, queryConf, headerConf)
+		if err == nil || attempt >= maxRetries || !isRetryable(err) {
+			return data, err
+		}
+		wait := delay + rand.N(delay/2+1)
+		var statusCodeError *azal.StatusCodeError
+		if errors.As(err, &statusCodeError) && statusCodeError.RetryAfter > wait {
+			wait = min(statusCodeError.RetryAfter, MaxRateLimitDelay)
+		}
+		logger.Warn(
+			LogFields{Event: "retry", Route: Route{From: queryConf.From, To: queryConf.To}.String(), Day: queryConf.DepartureDate},
+			"Request failed, retrying in ", wait.Round(time.Millisecond), ": ", err.Error(),
+		)
+		if !sleepContext(ctx, wait) {
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// CircuitBreaker stops the requests to the API for Cooldown after Threshold failed
+// requests within Window. After the cooldown it lets a single request through
+// (half-open): if that one succeeds the circuit closes again, otherwise it stays
+// open for another cooldown. A nil CircuitBreaker never opens.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+	// OnChange is called when the circuit opens or closes, outside of the lock.
+	OnChange func(open bool, reason string)
+	failures []time.Time
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a request may be sent now.
+func (circuitBreaker *CircuitBreaker) allow() bool {
+	circuitBreaker.mu.Lock()
+	defer circuitBreaker.mu.Unlock()
+	if !circuitBreaker.open {
+		return true
+	}
+	if circuitBreaker.probing || time.Since(circuitBreaker.openedAt) < circuitBreaker.Cooldown {
+		return false
+	}
+	circuitBreaker.probing = true
+	return true
+}
+
+// record counts the result of an allowed request, opening or closing the circuit.
+func (circuitBreaker *CircuitBreaker) record(failed bool) {
+	circuitBreaker.mu.Lock()
+	var (
+		changed bool
+		reason  string
+	)
+	now := time.Now()
+	switch {
+	case circuitBreaker.probing:
+		circuitBreaker.probing = false
+		if failed {
+			circuitBreaker.openedAt = now
+			logger.Warn(LogFields{Event: "circuit_half_open_failed"}, "The test request failed, the circuit breaker stays open for ", circuitBreaker.Cooldown)
+		} else {
+			circuitBreaker.open, circuitBreaker.failures = false, nil
+			changed, reason = true, "the test request succeeded"
+		}
+	case failed && !circuitBreaker.open:
+		circuitBreaker.failures = append(circuitBreaker.failures, now)
+		for len(circuitBreaker.failures) > 0 && now.Sub(circuitBreaker.failures[0]) > circuitBreaker.Window {
+			circuitBreaker.failures = circuitBreaker.failures[1:]
+		}
+		if len(circuitBreaker.failures) >= circuitBreaker.Threshold {
+			circuitBreaker.open, circuitBreaker.openedAt = true, now
+			changed = true
+			reason = fmt.Sprintf("%d requests failed within %s, pausing the requests for %s", len(circuitBreaker.failures), circuitBreaker.Window, circuitBreaker.Cooldown)
+		}
+	}
+	open := circuitBreaker.open
+	circuitBreaker.mu.Unlock()
+	if changed && circuitBreaker.OnChange != nil {
+		circuitBreaker.OnChange(open, reason)
+	}
+}
+
+// sendRequest sends the request through sendRequestWithRetry unless the circuit is open.
+// Only connection errors and bad responses count as failures, not "no flights".
+func (circuitBreaker *CircuitBreaker) sendRequest(ctx context.Context, client *http.Client, apiURL string, queryConf *azal.QueryConfig, headerConf *azal.HeaderConfig, maxRetries uint) (*azal.SuccessResponse, error) {
+	if circuitBreaker == nil {
+		return sendRequestWithRetry(ctx, client, apiURL, queryConf, headerConf, maxRetries)
+	}
+	if !circuitBreaker.allow() {
+		return nil, ErrorCircuitOpen
+	}
+	data, err := sendRequestWithRetry(ctx, client, apiURL, queryConf, headerConf, maxRetries)
+	if ctx.Err() != nil {
+		// A cancelled request says nothing about the API; give the probe back.
+		circuitBreaker.mu.Lock()
+		circuitBreaker.probing = false
+		circuitBreaker.mu.Unlock()
+		return data, err
+	}
+	circuitBreaker.record(err != nil && err != azal.ErrorNoFlightsAvailable && err != azal.ErrorFlowInterrupted && err != ErrorBudgetExhausted)
+	return data, err
+}
+
+// sleepContext sleeps for d and reports whether it slept the whole time,
+// false means ctx was cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// parseDate accepts either '2006-01-02T15:04:05', '2006-01-02' or a relative day like "today", "+7d" or "+2w".
+// dateOnly reports whether the value had no time part.
+func parseDate(value string) (t time.Time, dateOnly bool, err error) {
+	if isRelativeDate(value) {
+		t, err = parseRelativeDate(value, time.Now())
+		return t, true, err
+	}
+	t, err = time.ParseInLocation("2006-01-02T15:04:05", value, Timezone)
+	if err == nil {
+		return t, false, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", value, Timezone)
+	if err != nil {
+		return t, false, err
+	}
+	return t, true, nil
+}
+
+func isRelativeDate(value string) bool {
+	return strings.HasPrefix(value, "today") || strings.HasPrefix(value, "+")
+}
+
+// parseRelativeDate resolves "today", "+Nd", "+Nw" or "today+Nd" to the start of that day in Timezone.
+func parseRelativeDate(value string, now time.Time) (time.Time, error) {
+	now = now.In(Timezone)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, Timezone)
+	offset := strings.TrimPrefix(value, "today")
+	if offset == "" {
+		return today, nil
+	}
+
+	invalid := fmt.Errorf("invalid relative date %q, expected today, +Nd or +Nw (e.g. +7d)", value)
+	if len(offset) < 3 || offset[0] != '+' {
+		return time.Time{}, invalid
+	}
+	count, err := strconv.ParseUint(offset[1:len(offset)-1], 10, 16)
+	if err != nil {
+		return time.Time{}, invalid
+	}
+	switch offset[len(offset)-1] {
+	case 'd':
+		return today.AddDate(0, 0, int(count)), nil
+	case 'w':
+		return today.AddDate(0, 0, 7*int(count)), nil
+	}
+	return time.Time{}, invalid
+}
+
+// parseInterval accepts Go duration strings like "5m" or "1h30s".
+// Bare integers are treated as seconds for backward compatibility.
+func parseInterval(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// QuietHours is a daily window, in Timezone, during which no notifications are sent.
+// Start and End are offsets from midnight; a window with End before Start wraps past midnight.
+type QuietHours struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// parseQuietHours parses a window like "22:00-07:00".
+func parseQuietHours(value string) (*QuietHours, error) {
+	start, end, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected a window like 22:00-07:00, got %q", value)
+	}
+	quietHours := &QuietHours{}
+	for _, part := range []struct {
+		value string
+		dst   *time.Duration
+	}{{start, &quietHours.Start}, {end, &quietHours.End}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part.value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q, expected HH:MM", part.value)
+		}
+		*part.dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if quietHours.Start == quietHours.End {
+		return nil, fmt.Errorf("start and end of %q are the same", value)
+	}
+	return quietHours, nil
+}
+
+func (quietHours *QuietHours) contains(t time.Time) bool {
+	if quietHours == nil {
+		return false
+	}
+	t = t.In(Timezone)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if quietHours.Start < quietHours.End {
+		return offset >= quietHours.Start && offset < quietHours.End
+	}
+	return offset >= quietHours.Start || offset < quietHours.End
+}
+
+func getUserInput() *UserInput {
+	var (
+		firstDate,
 		lastDate,
-		from,
-		to,
+		returnDate,
+		returnFrom,
+		returnTo,
 		telegramBotKey,
-		telegramChatID string
-		repetInterval uint32
-		userInput     = &UserInput{}
+		discordWebhook,
+		slackWebhook,
+		pushoverToken,
+		pushoverUser,
+		ntfyURL,
+		ntfyToken,
+		matrixHomeserver,
+		matrixToken,
+		matrixRoom,
+		smtpHost,
+		smtpUser,
+		smtpPass,
+		emailFrom,
+		twilioSID,
+		twilioToken,
+		twilioFrom,
+		webhookURL,
+		primaryBackend,
+		fallbackBackend,
+		logFormat,
+		logLevel,
+		logFile,
+		timezone,
+		proxy,
+		apiURL,
+		telegramAPIURL,
+		apiAuthValue,
+		bearerToken,
+		metricsAddr,
+		healthAddr,
+		csvFile,
+		stateFile,
+		dumpResponses,
+		messageTemplate,
+		bookingURLTemplate,
+		instanceName,
+		dateFormat,
+		timeFormat,
+		quietHours,
+		notifyCooldown,
+		summaryInterval,
+		latencyStatsInterval,
+		maxBackoffInterval,
+		breakerWindow,
+		breakerCooldown,
+		currency,
+		locale,
+		cabinClass,
+		displayCurrency,
+		fxURL,
+		duration,
+		until,
+		repetInterval,
+		configPath string
+		routeNotifications []RouteNotification
+		routeIntervals     map[string]string
+		requestTimeout,
+		webhookTimeout uint32
+		once,
+		exitOnFirstMatch,
+		warmupNoNotify,
+		compact,
+		trace,
+		failFast,
+		disableHTTP2,
+		disableKeepAlive,
+		noColor,
+		strictCodes,
+		notifyErrors,
+		notifyRemovals,
+		testNotify,
+		noStartNotification,
+		dailyStartNotification,
+		randomUserAgent,
+		allFares,
+		includeSoldOut,
+		printDeeplink,
+		outputJSON,
+		verbose,
+		dryRun bool
+		maxRetries,
+		maxRequests,
+		backoffAfter,
+		breakerThreshold,
+		concurrency,
+		jitter,
+		smtpPort,
+		adults,
+		children,
+		minSeats,
+		minAdvanceDays,
+		maxAdvanceDays,
+		maxNotificationsPerDay,
+		logMaxSize,
+		logBackups,
+		infants,
+		infantsWithSeat uint
+		maxPrice,
+		requestRate float64
+		seed           uint64
+		from, to       []string
+		telegramChatID []string
+		emailTo        []string
+		dates          []string
+		smsTo          []string
+		userInput      = &UserInput{}
 	)
 
-	var rootCmd = &cobra.Command{
-		Use:     "Azal Bot",
-		Short:   "A CLI tool to find the flights",
-		Version: Version,
-		Run: func(cmd *cobra.Command, args []string) {
-			first, err := time.Parse("2006-01-02T15:04:05", firstDate)
-			if err != nil {
-				first, err = time.Parse("2006-01-02", firstDate)
+	var rootCmd = &cobra.Command{
+		Use:     "Azal Bot",
+		Short:   "A CLI tool to find the flights",
+		Version: Version,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Secrets can come from the environment to keep them out of the shell history.
+			// A flag always wins, then the environment, then the config file.
+			for name, env := range map[string]string{
+				"telegram-bot-key": "AZALBOT_TELEGRAM_BOT_KEY",
+				"telegram-chat-id": "AZALBOT_TELEGRAM_CHAT_ID",
+			} {
+				if value := os.Getenv(env); value != "" && !cmd.Flags().Changed(name) {
+					if err := cmd.Flags().Set(name, value); err != nil {
+						fmt.Printf("Error: %s: %v\n", env, err)
+						os.Exit(1)
+					}
+				}
+			}
+			if configPath != "" {
+				configFile, err := loadConfigFile(configPath)
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+				if err := configFile.setToFlags(cmd.Flags()); err != nil {
+					fmt.Printf("Error: config %s: %v\n", configPath, err)
+					os.Exit(1)
+				}
+				routeNotifications = configFile.RouteNotifications
+				routeIntervals = configFile.RouteIntervals
+			}
+			for name, value := range map[string]string{
+				"first-date": firstDate,
+				"last-date":  lastDate,
+				"from":       strings.Join(from, ","),
+				"to":         strings.Join(to, ","),
+			} {
+				if value == "" && (len(dates) == 0 || name == "from" || name == "to") {
+					fmt.Printf("Error: %s is required (set it with a flag or in the config file)\n", name)
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+
+			location, err := time.LoadLocation(timezone)
+			if err != nil {
+				fmt.Printf("Error: loading Timezone: %v\n", err)
+				cmd.Help()
+				os.Exit(1)
+			}
+			Timezone = location
+
+			instanceName = strings.TrimSpace(instanceName)
+			if instanceName == "" {
+				fmt.Println("Error: instanceName can't be empty")
+				cmd.Help()
+				os.Exit(1)
+			}
+			InstanceName = instanceName
+
+			layout, err := parseLayout(dateFormat, DateFormatPresets)
+			if err != nil {
+				fmt.Printf("Error: dateFormat: %v\n", err)
+				cmd.Help()
+				os.Exit(1)
+			}
+			DateFormat = layout
+			layout, err = parseLayout(timeFormat, TimeFormatPresets)
+			if err != nil {
+				fmt.Printf("Error: timeFormat: %v\n", err)
+				cmd.Help()
+				os.Exit(1)
+			}
+			TimeFormat = layout
+
+			if messageTemplate != "" {
+				if path, ok := strings.CutPrefix(messageTemplate, "@"); ok {
+					data, err := os.ReadFile(path)
+					if err != nil {
+						fmt.Printf("Error: reading MessageTemplate: %v\n", err)
+						cmd.Help()
+						os.Exit(1)
+					}
+					messageTemplate = string(data)
+				}
+				tmpl, err := parseMessageTemplate(messageTemplate)
+				if err == nil {
+					// Catch references to unknown fields before the first notification.
+					err = tmpl.Execute(io.Discard, MessageData{Days: []MessageDay{{
+						Key: "NAJ-BAK 2024-09-24", Route: "NAJ-BAK", Day: "2024-09-24", Heading: "NAJ-BAK " + formatDay("2024-09-24"),
+						Flights: []AvialableFlight{{DepartureDate: time.Now()}},
+					}}})
+				}
+				if err != nil {
+					fmt.Printf("Error: parsing MessageTemplate: %v\n", err)
+					cmd.Help()
+					os.Exit(1)
+				}
+				MessageTemplate = tmpl
+			}
+			if compact {
+				if messageTemplate != "" {
+					fmt.Println("Error: compact and messageTemplate can't be used together")
+					cmd.Help()
+					os.Exit(1)
+				}
+				MessageTemplate = template.Must(parseMessageTemplate(CompactMessageTemplate))
+				CompactMessages = true
+			}
+			if bookingURLTemplate != "" {
+				tmpl, err := template.New("booking").Parse(bookingURLTemplate)
+				if err == nil {
+					// Render a sample link so unknown fields and non-URLs are caught now, not in the notifications.
+					previous := BookingURLTemplate
+					BookingURLTemplate = tmpl
+					queryConf := azal.QueryConfig{From: "NAJ", To: "BAK", DepartureDate: "2024-09-24"}
+					queryConf.SetDefaults()
+					_, err = bookingURL(&queryConf)
+					BookingURLTemplate = previous
+				}
+				if err != nil {
+					fmt.Printf("Error: parsing BookingURLTemplate: %v\n", err)
+					cmd.Help()
+					os.Exit(1)
+				}
+				BookingURLTemplate = tmpl
+			}
+
+			var first, last time.Time
+			if len(dates) > 0 {
+				// Explicit dates replace the FirstDate-LastDate range; the range is set to span them.
+				if firstDate != "" || lastDate != "" {
+					fmt.Println("Error: dates can't be used together with firstDate and lastDate")
+					cmd.Help()
+					os.Exit(1)
+				}
+				var days []time.Time
+				for _, value := range dates {
+					day, err := time.ParseInLocation("2006-01-02", value, Timezone)
+					if err != nil {
+						fmt.Printf("Error: parsing Dates: %v\n", err)
+						cmd.Help()
+						os.Exit(1)
+					}
+					if slices.ContainsFunc(days, day.Equal) {
+						fmt.Printf("Error: date %s is given more than once\n", value)
+						cmd.Help()
+						os.Exit(1)
+					}
+					days = append(days, day)
+				}
+				slices.SortFunc(days, time.Time.Compare)
+				for _, day := range days {
+					userInput.Dates = append(userInput.Dates, day.Format("2006-01-02"))
+				}
+				first, last = days[0], days[len(days)-1].AddDate(0, 0, 1).Add(-time.Second)
+			} else {
+				first, _, err = parseDate(firstDate)
+				if err != nil {
+					fmt.Printf("Error: parsing FirstDate: %v\n", err)
+					cmd.Help()
+					os.Exit(1)
+				}
+				var dateOnly bool
+				last, dateOnly, err = parseDate(lastDate)
+				if err != nil {
+					fmt.Printf("Error: parsing LastDate: %v\n", err)
+					cmd.Help()
+					os.Exit(1)
+				}
+				if dateOnly {
+					last = last.AddDate(0, 0, 1)
+					last = last.Add(-time.Second)
+				}
+			}
+			if first.After(last) || first.Equal(last) {
+				fmt.Println("Error: first date should be before last date and they should not be equal")
+				cmd.Help()
+				os.Exit(1)
+			}
+			var returnDay time.Time
+			if returnDate != "" {
+				returnDay, err = time.ParseInLocation("2006-01-02", returnDate, Timezone)
+				if err != nil {
+					fmt.Printf("Error: parsing ReturnDate: %v\n", err)
+					cmd.Help()
+					os.Exit(1)
+				}
+				if !returnDay.After(first) {
+					fmt.Println("Error: return date should be after first date")
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			interval, err := parseInterval(repetInterval)
+			if err != nil {
+				fmt.Printf("Error: parsing RepetInterval: %v\n", err)
+				cmd.Help()
+				os.Exit(1)
+			}
+			if interval < MinRepetInterval {
+				fmt.Printf("Error: repetInterval should be at least %s\n", MinRepetInterval)
+				cmd.Help()
+				os.Exit(1)
+			}
+			if requestTimeout < 1 {
+				fmt.Println("Error: requestTimeout should be greater than 0")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if jitter > 100 {
+				fmt.Println("Error: jitter should be between 0 and 100")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if requestRate < 0 {
+				fmt.Println("Error: rateLimit should not be negative")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if concurrency < 1 || concurrency > MaxConcurrency {
+				fmt.Printf("Error: concurrency should be between 1 and %d\n", MaxConcurrency)
+				cmd.Help()
+				os.Exit(1)
+			}
+			if adults < 1 {
+				fmt.Println("Error: adults should be at least 1")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if infants > adults {
+				fmt.Println("Error: infants should not exceed adults, each lap infant needs an adult (see --infants-with-seat)")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if adults+children+infants+infantsWithSeat > MaxPassengers {
+				fmt.Printf("Error: total passengers should not exceed %d\n", MaxPassengers)
+				cmd.Help()
+				os.Exit(1)
+			}
+			var proxyURL *url.URL
+			if proxy != "" {
+				proxyURL, err = url.Parse(proxy)
+				if err != nil {
+					fmt.Printf("Error: parsing Proxy: %v\n", err)
+					cmd.Help()
+					os.Exit(1)
+				}
+				if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5" {
+					fmt.Println("Error: proxy scheme should be http, https or socks5")
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			for name, value := range map[string]string{"apiURL": apiURL, "telegramAPIURL": telegramAPIURL} {
+				if parsed, err := url.Parse(value); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+					fmt.Printf("Error: %s should be an http or https URL\n", name)
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if apiAuthValue != "" && bearerToken != "" {
+				fmt.Println("Error: apiAuthValue and bearerToken can't be used together")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if logFormat != "text" && logFormat != "json" {
+				fmt.Println("Error: logFormat should be either text or json")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if verbose {
+				logLevel = "debug"
+			}
+			if _, ok := LogLevels[logLevel]; !ok {
+				fmt.Println("Error: logLevel should be one of error, warn, info or debug")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if len(from) != len(to) {
+				fmt.Println("Error: from and to should have the same number of values")
+				cmd.Help()
+				os.Exit(1)
+			}
+			var routes []Route
+			for i := range from {
+				if len(from[i]) > 5 || len(from[i]) < 2 {
+					fmt.Println("Error: from should be between 2 and 5 characters")
+					cmd.Help()
+					os.Exit(1)
+				}
+				if len(to[i]) > 5 || len(to[i]) < 2 {
+					fmt.Println("Error: to should be between 2 and 5 characters")
+					cmd.Help()
+					os.Exit(1)
+				}
+				for _, code := range []string{from[i], to[i]} {
+					if _, ok := airports[code]; ok {
+						continue
+					}
+					if strictCodes {
+						fmt.Printf("Error: unknown airport code: %s\n", code)
+						cmd.Help()
+						os.Exit(1)
+					}
+					fmt.Fprintln(os.Stderr, Colored(Colors.Yellow, "Warning: unknown airport code: ", code))
+				}
+				routes = append(routes, Route{From: from[i], To: to[i]})
+			}
+			if returnFrom != "" || returnTo != "" {
+				if returnFrom == "" || returnTo == "" {
+					fmt.Println("Error: returnFrom and returnTo are required together")
+					cmd.Help()
+					os.Exit(1)
+				}
+				if returnDate == "" {
+					fmt.Println("Error: returnDate is required if returnFrom and returnTo are provided")
+					cmd.Help()
+					os.Exit(1)
+				}
+				for _, code := range []string{returnFrom, returnTo} {
+					if len(code) > 5 || len(code) < 2 {
+						fmt.Println("Error: returnFrom and returnTo should be between 2 and 5 characters")
+						cmd.Help()
+						os.Exit(1)
+					}
+					if _, ok := airports[code]; ok {
+						continue
+					}
+					if strictCodes {
+						fmt.Printf("Error: unknown airport code: %s\n", code)
+						cmd.Help()
+						os.Exit(1)
+					}
+					fmt.Fprintln(os.Stderr, Colored(Colors.Yellow, "Warning: unknown airport code: ", code))
+				}
+				userInput.ReturnRoute = &Route{From: returnFrom, To: returnTo}
+			}
+			if telegramBotKey != "" {
+				if len(telegramChatID) == 0 {
+					fmt.Println("Error: telegramChatID is required if telegramBotKey is provided")
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if len(telegramChatID) > 0 {
+				if telegramBotKey == "" {
+					fmt.Println("Error: telegramBotKey is required if telegramChatID is provided")
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if (pushoverToken == "") != (pushoverUser == "") {
+				fmt.Println("Error: pushoverToken and pushoverUser are required together")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if ntfyToken != "" && ntfyURL == "" {
+				fmt.Println("Error: ntfyURL is required if ntfyToken is provided")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if matrixHomeserver != "" || matrixToken != "" || matrixRoom != "" {
+				if matrixHomeserver == "" || matrixToken == "" || matrixRoom == "" {
+					fmt.Println("Error: matrixHomeserver, matrixToken and matrixRoom are required together")
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if smtpHost != "" || smtpUser != "" || smtpPass != "" || emailFrom != "" || len(emailTo) > 0 {
+				if smtpHost == "" || emailFrom == "" || len(emailTo) == 0 {
+					fmt.Println("Error: smtpHost, emailFrom and emailTo are required together")
+					cmd.Help()
+					os.Exit(1)
+				}
+				if (smtpUser == "") != (smtpPass == "") {
+					fmt.Println("Error: smtpUser and smtpPass are required together")
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if twilioSID != "" || twilioToken != "" || twilioFrom != "" || len(smsTo) > 0 {
+				if twilioSID == "" || twilioToken == "" || twilioFrom == "" || len(smsTo) == 0 {
+					fmt.Println("Error: twilioSID, twilioToken, twilioFrom and smsTo are required together")
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			if len(routeNotifications) > 0 {
+				watched := make(map[string]bool)
+				for _, route := range routes {
+					watched[route.String()] = true
+					if !returnDay.IsZero() && userInput.ReturnRoute == nil {
+						watched[route.To+"-"+route.From] = true
+					}
+				}
+				if userInput.ReturnRoute != nil {
+					watched[userInput.ReturnRoute.String()] = true
+				}
+				for _, routeNotification := range routeNotifications {
+					if !watched[routeNotification.Route] {
+						fmt.Printf("Error: route-notifications: %s is not one of the watched routes\n", routeNotification.Route)
+						cmd.Help()
+						os.Exit(1)
+					}
+					if len(routeNotification.TelegramChatID) > 0 && telegramBotKey == "" {
+						fmt.Printf("Error: route-notifications: %s: telegramBotKey is required for telegram-chat-id\n", routeNotification.Route)
+						cmd.Help()
+						os.Exit(1)
+					}
+				}
+			}
+
+			userInput.FirstDate = first
+			userInput.LastDate = last
+			userInput.ReturnDate = returnDay
+			userInput.Routes = routes
+			userInput.TelegramBotKey = telegramBotKey
+			userInput.TelegramChatIDs = telegramChatID
+			userInput.DiscordWebhook = discordWebhook
+			userInput.SlackWebhook = slackWebhook
+			userInput.PushoverToken = pushoverToken
+			userInput.PushoverUser = pushoverUser
+			userInput.NtfyURL = ntfyURL
+			userInput.NtfyToken = ntfyToken
+			userInput.MatrixHomeserver = matrixHomeserver
+			userInput.MatrixToken = matrixToken
+			userInput.MatrixRoom = matrixRoom
+			userInput.SMTPHost = smtpHost
+			userInput.SMTPPort = smtpPort
+			userInput.SMTPUser = smtpUser
+			userInput.SMTPPass = smtpPass
+			userInput.EmailFrom = emailFrom
+			userInput.EmailTo = emailTo
+			userInput.TwilioSID = twilioSID
+			userInput.TwilioToken = twilioToken
+			userInput.TwilioFrom = twilioFrom
+			userInput.SMSTo = smsTo
+			userInput.WebhookURL = webhookURL
+			userInput.WebhookTimeout = time.Duration(webhookTimeout) * time.Second
+			primaryBackend, fallbackBackend = strings.ToLower(primaryBackend), strings.ToLower(fallbackBackend)
+			if (primaryBackend == "") != (fallbackBackend == "") {
+				fmt.Println("Error: primaryBackend and fallbackBackend should be given together")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if primaryBackend != "" {
+				if !slices.Contains(Backends, primaryBackend) || !slices.Contains(Backends, fallbackBackend) {
+					fmt.Printf("Error: primaryBackend and fallbackBackend should be one of %s\n", strings.Join(Backends, ", "))
+					cmd.Help()
+					os.Exit(1)
+				}
+				if primaryBackend == fallbackBackend {
+					fmt.Println("Error: primaryBackend and fallbackBackend should be different")
+					cmd.Help()
+					os.Exit(1)
+				}
+			}
+			userInput.PrimaryBackend = primaryBackend
+			userInput.FallbackBackend = fallbackBackend
+			userInput.RouteNotifications = routeNotifications
+			if len(routeIntervals) > 0 {
+				searched := make(map[string]bool)
+				for _, route := range routes {
+					searched[route.String()] = true
+				}
+				if userInput.ReturnRoute != nil {
+					searched[userInput.ReturnRoute.String()] = true
+				}
+				userInput.RouteIntervals = make(map[string]time.Duration, len(routeIntervals))
+				for route, value := range routeIntervals {
+					if !searched[route] {
+						fmt.Printf("Error: route-intervals: %s is not one of the searched routes\n", route)
+						cmd.Help()
+						os.Exit(1)
+					}
+					// loadConfigFile already checked the value.
+					userInput.RouteIntervals[route], _ = parseInterval(value)
+				}
+			}
+			userInput.StateFile = stateFile
+			if noStartNotification && dailyStartNotification {
+				fmt.Println("Error: noStartNotification and dailyStartNotification can't be used together")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if dailyStartNotification && stateFile == "" {
+				fmt.Println("Error: stateFile is required if dailyStartNotification is set")
+				cmd.Help()
+				os.Exit(1)
+			}
+			userInput.NoStartNotification = noStartNotification
+			userInput.DailyStartNotification = dailyStartNotification
+			userInput.DumpResponsesDir = dumpResponses
+			userInput.Trace = trace
+			userInput.CSVFile = csvFile
+			userInput.MetricsAddr = metricsAddr
+			userInput.HealthAddr = healthAddr
+			userInput.LogFormat = logFormat
+			userInput.LogLevel = logLevel
+			if logFile != "" && logMaxSize < 1 {
+				fmt.Println("Error: logMaxSize should be at least 1")
+				cmd.Help()
+				os.Exit(1)
+			}
+			userInput.LogFile = logFile
+			userInput.LogMaxSize = logMaxSize
+			userInput.LogBackups = logBackups
+			userInput.NoColor = noColor
+			userInput.NotifyErrors = notifyErrors
+			userInput.NotifyRemovals = notifyRemovals
+			userInput.Proxy = proxyURL
+			userInput.DisableHTTP2 = disableHTTP2
+			userInput.DisableKeepAlive = disableKeepAlive
+			userInput.APIURL = apiURL
+			userInput.TelegramAPIURL = telegramAPIURL
+			userInput.APIAuthorization = apiAuthValue
+			if bearerToken != "" {
+				userInput.APIAuthorization = "Bearer " + bearerToken
+			}
+			if once && exitOnFirstMatch {
+				fmt.Println("Error: once and exitOnFirstMatch can't be used together")
+				cmd.Help()
+				os.Exit(1)
+			}
+			userInput.Once = once
+			if once && warmupNoNotify {
+				fmt.Println("Error: once and warmupNoNotify can't be used together")
+				cmd.Help()
+				os.Exit(1)
+			}
+			userInput.ExitOnFirstMatch = exitOnFirstMatch
+			userInput.WarmupNoNotify = warmupNoNotify
+			userInput.FailFast = failFast
+			userInput.DryRun = dryRun
+			userInput.TestNotify = testNotify
+			userInput.PrintDeeplink = printDeeplink
+			userInput.OutputJSON = outputJSON
+			userInput.MaxRetries = maxRetries
+			if backoffAfter > 0 {
+				backoff, err := time.ParseDuration(maxBackoffInterval)
+				if err != nil || backoff < interval {
+					fmt.Printf("Error: maxBackoffInterval should be a duration like 30m of at least the repetInterval, got %q\n", maxBackoffInterval)
+					cmd.Help()
+					os.Exit(1)
+				}
+				userInput.MaxBackoffInterval = backoff
+			}
+			userInput.BackoffAfter = backoffAfter
+			if breakerThreshold > 0 {
+				window, err := time.ParseDuration(breakerWindow)
+				if err != nil || window <= 0 {
+					fmt.Printf("Error: breakerWindow should be a positive duration like 5m, got %q\n", breakerWindow)
+					cmd.Help()
+					os.Exit(1)
+				}
+				cooldown, err := time.ParseDuration(breakerCooldown)
+				if err != nil || cooldown <= 0 {
+					fmt.Printf("Error: breakerCooldown should be a positive duration like 10m, got %q\n", breakerCooldown)
+					cmd.Help()
+					os.Exit(1)
+				}
+				userInput.BreakerWindow = window
+				userInput.BreakerCooldown = cooldown
+			}
+			userInput.BreakerThreshold = breakerThreshold
+			userInput.Concurrency = concurrency
+			userInput.RateLimit = requestRate
+			userInput.MaxRequests = maxRequests
+			if cmd.Flags().Changed("seed") && !randomUserAgent {
+				fmt.Println("Error: randomUserAgent is required if seed is provided")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if randomUserAgent && !cmd.Flags().Changed("seed") {
+				seed = rand.Uint64()
+			}
+			userInput.RandomUserAgent = randomUserAgent
+			userInput.Seed = seed
+			userInput.Adults = adults
+			userInput.Children = children
+			userInput.Infants = infants
+			userInput.InfantsWithSeat = infantsWithSeat
+			userInput.MaxPrice = maxPrice
+			userInput.MinSeats = minSeats
+			if maxAdvanceDays > 0 && maxAdvanceDays <= minAdvanceDays {
+				fmt.Println("Error: maxAdvanceDays should be greater than minAdvanceDays")
+				cmd.Help()
+				os.Exit(1)
+			}
+			userInput.MinAdvanceDays = minAdvanceDays
+			userInput.MaxAdvanceDays = maxAdvanceDays
+			userInput.MaxNotificationsPerDay = maxNotificationsPerDay
+			userInput.RepetInterval = interval
+			userInput.Jitter = jitter
+			userInput.RequestTimeout = time.Duration(requestTimeout) * time.Second
+			if quietHours != "" {
+				window, err := parseQuietHours(quietHours)
 				if err != nil {
-					fmt.Printf("Error: parsing FirstDate: %v\n", err)
+					fmt.Printf("Error: parsing QuietHours: %v\n", err)
+					cmd.Help()
+					os.Exit(1)
+				}
+				userInput.QuietHours = window
+			}
+			currency = strings.ToUpper(currency)
+			if !slices.Contains(Currencies, currency) {
+				fmt.Printf("Error: currency should be one of %s\n", strings.Join(Currencies, ", "))
+				cmd.Help()
+				os.Exit(1)
+			}
+			userInput.Currency = currency
+			locale = strings.ToLower(locale)
+			if !slices.Contains(Locales, locale) {
+				fmt.Printf("Error: locale should be one of %s\n", strings.Join(Locales, ", "))
+				cmd.Help()
+				os.Exit(1)
+			}
+			userInput.Locale = locale
+			displayCurrency = strings.ToUpper(displayCurrency)
+			if displayCurrency != "" && (len(displayCurrency) != 3 || strings.Trim(displayCurrency, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "") {
+				fmt.Println("Error: displayCurrency should be a 3 letter currency code like USD")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if displayCurrency != currency {
+				userInput.DisplayCurrency = displayCurrency
+			}
+			userInput.FXURL = fxURL
+			cabinClass = strings.ToLower(cabinClass)
+			if cabinClass != "" && !slices.Contains(CabinClasses, cabinClass) {
+				fmt.Printf("Error: cabinClass should be one of %s\n", strings.Join(CabinClasses, ", "))
+				cmd.Help()
+				os.Exit(1)
+			}
+			userInput.CabinClass = cabinClass
+			userInput.AllFares = allFares
+			userInput.IncludeSoldOut = includeSoldOut
+			if notifyCooldown != "" {
+				cooldown, err := time.ParseDuration(notifyCooldown)
+				if err != nil || cooldown < 0 {
+					fmt.Printf("Error: notifyCooldown should be a duration like 6h, got %q\n", notifyCooldown)
+					cmd.Help()
+					os.Exit(1)
+				}
+				userInput.NotifyCooldown = cooldown
+			}
+			if summaryInterval != "" {
+				summary, err := time.ParseDuration(summaryInterval)
+				if err != nil || summary < interval {
+					fmt.Printf("Error: summaryInterval should be a duration like 6h of at least the repetInterval, got %q\n", summaryInterval)
+					cmd.Help()
+					os.Exit(1)
+				}
+				if notifyRemovals {
+					// The digest only lists the flights found in the window, so the removals would be lost.
+					fmt.Println("Error: summaryInterval and notifyRemovals can't be used together")
+					cmd.Help()
+					os.Exit(1)
+				}
+				userInput.SummaryInterval = summary
+			}
+			if latencyStatsInterval != "" {
+				statsInterval, err := time.ParseDuration(latencyStatsInterval)
+				if err != nil || statsInterval <= 0 {
+					fmt.Printf("Error: latencyStatsInterval should be a positive duration like 1h, got %q\n", latencyStatsInterval)
+					cmd.Help()
+					os.Exit(1)
+				}
+				userInput.LatencyStatsInterval = statsInterval
+			}
+			if duration != "" && until != "" {
+				fmt.Println("Error: duration and until can't be used together")
+				cmd.Help()
+				os.Exit(1)
+			}
+			if duration != "" {
+				runtime, err := time.ParseDuration(duration)
+				if err != nil || runtime <= 0 {
+					fmt.Printf("Error: duration should be a positive duration like 6h, got %q\n", duration)
+					cmd.Help()
+					os.Exit(1)
+				}
+				userInput.Deadline = time.Now().Add(runtime)
+			}
+			if until != "" {
+				deadline, _, err := parseDate(until)
+				if err != nil {
+					fmt.Printf("Error: parsing Until: %v\n", err)
+					cmd.Help()
+					os.Exit(1)
+				}
+				if !deadline.After(time.Now()) {
+					fmt.Println("Error: until should be in the future")
 					cmd.Help()
 					os.Exit(1)
 				}
+				userInput.Deadline = deadline
+			}
+		},
+	}
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	// check runs the same validation as the root command, then main prints a summary and exits.
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "check",
+		Short: "Validate the flags and the config file, print what the bot would do and exit",
+		Run: func(cmd *cobra.Command, args []string) {
+			rootCmd.Run(cmd, args)
+			userInput.Check = true
+		},
+	})
+	// test-notify builds the notification backends like the root command, then main tests each of them and exits.
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "test-notify",
+		Short: "Send a test notification through every configured backend and report the result of each",
+		Run: func(cmd *cobra.Command, args []string) {
+			rootCmd.Run(cmd, args)
+			userInput.TestNotifyCommand = true
+		},
+	})
+
+	// telegram-chat-id only needs the bot key, so it skips the validation of the root command.
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "telegram-chat-id",
+		Short: "Print the chats that recently messaged the bot, to find the --telegram-chat-id",
+		Run: func(cmd *cobra.Command, args []string) {
+			if value := os.Getenv("AZALBOT_TELEGRAM_BOT_KEY"); value != "" && !cmd.Flags().Changed("telegram-bot-key") {
+				cmd.Flags().Set("telegram-bot-key", value)
+			}
+			if configPath != "" {
+				configFile, err := loadConfigFile(configPath)
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+				if err := configFile.setToFlags(cmd.Flags()); err != nil {
+					fmt.Printf("Error: config %s: %v\n", configPath, err)
+					os.Exit(1)
+				}
+			}
+			if telegramBotKey == "" {
+				fmt.Println("Error: telegramBotKey is required")
+				cmd.Help()
+				os.Exit(1)
+			}
+			telegramRequest := &TelegramRequest{
+				Client: &http.Client{Timeout: 30 * time.Second},
+				APIURL: telegramAPIURL,
+				BotKey: telegramBotKey,
+			}
+			if !printTelegramChats(telegramRequest) {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		},
+	})
+
+	// init-config writes the example config from the flags of the root command.
+	var forceInitConfig bool
+	initConfigCmd := &cobra.Command{
+		Use:   "init-config <path>",
+		Short: "Write an example config file with every key and its default",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := writeExampleConfig(args[0], rootCmd.PersistentFlags(), forceInitConfig); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Wrote the example config to %s\n", args[0])
+			os.Exit(0)
+		},
+	}
+	initConfigCmd.Flags().BoolVar(&forceInitConfig, "force", false, "Overwrite the file if it already exists")
+	rootCmd.AddCommand(initConfigCmd)
+
+	rootCmd.PersistentFlags().StringVarP(&firstDate, "first-date", "i", "", "First date in format '2006-01-02T15:04:05', '2006-01-02' or relative like 'today', '+7d', '+2w'")
+	rootCmd.PersistentFlags().StringSliceVar(&dates, "dates", nil, "Search only these days in format '2006-01-02', comma-separated (instead of --first-date and --last-date)")
+	rootCmd.PersistentFlags().StringVarP(&lastDate, "last-date", "l", "", "Last date in format '2006-01-02T15:04:05', '2006-01-02' or relative like '+30d'")
+	rootCmd.PersistentFlags().StringVar(&timezone, "timezone", "Asia/Baku", "IANA timezone of the dates and the displayed departure and arrival times")
+	rootCmd.PersistentFlags().StringVar(&dateFormat, "date-format", "2006-01-02", "Layout of the days in the notifications and logs: iso, eu, us, long or a Go layout like 02.01.2006")
+	rootCmd.PersistentFlags().StringVar(&timeFormat, "time-format", "15:04:05", "Layout of the departure times in the notifications and logs: 24h, 12h or a Go layout like 15:04")
+	rootCmd.PersistentFlags().StringVar(&returnDate, "return-date", "", "Return date in format '2006-01-02' (enables round-trip search)")
+	rootCmd.PersistentFlags().StringVar(&returnFrom, "return-from", "", "From where the return flight departs, if not the outbound --to (requires --return-date)")
+	rootCmd.PersistentFlags().StringVar(&returnTo, "return-to", "", "Where the return flight arrives, if not the outbound --from (requires --return-date)")
+	rootCmd.PersistentFlags().StringSliceVarP(&from, "from", "f", nil, "From where you want to fly (e.g. NAJ); repeat or comma-separate for several routes")
+	rootCmd.PersistentFlags().BoolVar(&strictCodes, "strict-codes", false, "Fail instead of warning on airport codes Azal is not known to serve")
+	rootCmd.PersistentFlags().StringSliceVarP(&to, "to", "t", nil, "To where you want to fly (e.g. BAK); one per --from value")
+	rootCmd.PersistentFlags().StringVar(&telegramBotKey, "telegram-bot-key", "", "Telegram bot key (env AZALBOT_TELEGRAM_BOT_KEY)")
+	rootCmd.PersistentFlags().StringSliceVar(&telegramChatID, "telegram-chat-id", nil, "Telegram chat id(s), comma-separated for several chats (env AZALBOT_TELEGRAM_CHAT_ID)")
+	rootCmd.PersistentFlags().StringVar(&discordWebhook, "discord-webhook", "", "Discord webhook URL")
+	rootCmd.PersistentFlags().StringVar(&slackWebhook, "slack-webhook", "", "Slack incoming webhook URL")
+	rootCmd.PersistentFlags().StringVar(&pushoverToken, "pushover-token", "", "Pushover application token")
+	rootCmd.PersistentFlags().StringVar(&pushoverUser, "pushover-user", "", "Pushover user key")
+	rootCmd.PersistentFlags().StringVar(&ntfyURL, "ntfy-url", "", "ntfy topic URL (e.g. https://ntfy.sh/my-flights)")
+	rootCmd.PersistentFlags().StringVar(&ntfyToken, "ntfy-token", "", "ntfy access token for authenticated servers")
+	rootCmd.PersistentFlags().StringVar(&matrixHomeserver, "matrix-homeserver", "", "Matrix homeserver URL (e.g. https://matrix.org)")
+	rootCmd.PersistentFlags().StringVar(&matrixToken, "matrix-token", "", "Matrix access token")
+	rootCmd.PersistentFlags().StringVar(&matrixRoom, "matrix-room", "", "Matrix room ID or alias the bot has joined")
+	rootCmd.PersistentFlags().StringVar(&smtpHost, "smtp-host", "", "SMTP server host for email notifications")
+	rootCmd.PersistentFlags().UintVar(&smtpPort, "smtp-port", 587, "SMTP server port")
+	rootCmd.PersistentFlags().StringVar(&smtpUser, "smtp-user", "", "SMTP username")
+	rootCmd.PersistentFlags().StringVar(&smtpPass, "smtp-pass", "", "SMTP password")
+	rootCmd.PersistentFlags().StringVar(&emailFrom, "email-from", "", "Sender address of email notifications")
+	rootCmd.PersistentFlags().StringSliceVar(&emailTo, "email-to", nil, "Recipient address(es) of email notifications")
+	rootCmd.PersistentFlags().StringVar(&twilioSID, "twilio-sid", "", "Twilio account SID for SMS notifications")
+	rootCmd.PersistentFlags().StringVar(&twilioToken, "twilio-token", "", "Twilio auth token")
+	rootCmd.PersistentFlags().StringVar(&twilioFrom, "twilio-from", "", "Twilio phone number the SMS are sent from")
+	rootCmd.PersistentFlags().StringSliceVar(&smsTo, "sms-to", nil, "Phone number(s) to send SMS notifications to")
+	rootCmd.PersistentFlags().StringVar(&webhookURL, "webhook-url", "", "URL to POST the available flights to as JSON")
+	rootCmd.PersistentFlags().StringVar(&primaryBackend, "primary-backend", "", "Backend whose failed notifications are sent through --fallback-backend instead")
+	rootCmd.PersistentFlags().StringVar(&fallbackBackend, "fallback-backend", "", "Backend that is only notified when --primary-backend fails")
+	rootCmd.PersistentFlags().Uint32Var(&webhookTimeout, "webhook-timeout", 10, "Timeout of a webhook request in seconds")
+	rootCmd.PersistentFlags().UintVar(&adults, "adults", 1, "Number of adult passengers")
+	rootCmd.PersistentFlags().UintVar(&children, "children", 0, "Number of child passengers")
+	rootCmd.PersistentFlags().UintVar(&infants, "infants", 0, "Number of infant passengers on an adult's lap (at most one per adult)")
+	rootCmd.PersistentFlags().UintVar(&infantsWithSeat, "infants-with-seat", 0, "Number of infant passengers with their own seat")
+	rootCmd.PersistentFlags().Float64Var(&maxPrice, "max-price", 0, "Only report flights at or below this fare in --currency (0 disables the filter)")
+	rootCmd.PersistentFlags().UintVar(&minSeats, "min-seats", 0, "Only report flights with at least this many seats left (flights without a seat count are kept)")
+	rootCmd.PersistentFlags().UintVar(&minAdvanceDays, "min-advance-days", 0, "Only report flights departing at least this many days from now")
+	rootCmd.PersistentFlags().UintVar(&maxAdvanceDays, "max-advance-days", 0, "Only report flights departing at most this many days from now (0 disables the bound)")
+	rootCmd.PersistentFlags().StringVar(&currency, "currency", "AZN", "Fare currency: "+strings.Join(Currencies, ", "))
+	rootCmd.PersistentFlags().StringVar(&locale, "locale", "az", "Language of the API's responses and error texts: "+strings.Join(Locales, ", "))
+	rootCmd.PersistentFlags().StringVar(&displayCurrency, "display-currency", "", "Also show the fares converted to this currency (e.g. USD), at the rate fetched at startup")
+	rootCmd.PersistentFlags().StringVar(&fxURL, "fx-url", FXAPIURL, "Exchange rate endpoint for --display-currency; {currency} is replaced by --currency")
+	rootCmd.PersistentFlags().BoolVar(&includeSoldOut, "include-sold-out", false, "Also report the flights that are sold out, marked SOLD OUT")
+	rootCmd.PersistentFlags().BoolVar(&allFares, "all-fares", false, "List every fare family of a flight with its price, not only the cheapest fare of each class")
+	rootCmd.PersistentFlags().StringVar(&cabinClass, "cabin-class", "", "Only report flights with this class: "+strings.Join(CabinClasses, ", ")+" (default all)")
+	rootCmd.PersistentFlags().UintVar(&concurrency, "concurrency", 4, fmt.Sprintf("Number of parallel requests (1-%d)", MaxConcurrency))
+	rootCmd.PersistentFlags().Float64Var(&requestRate, "rate-limit", 0, "Maximum requests per second to the API, shared by all parallel requests (0 = unlimited)")
+	rootCmd.PersistentFlags().BoolVar(&randomUserAgent, "random-user-agent", false, "Send a User-Agent picked from a pool of browser strings on each request instead of a fixed one")
+	rootCmd.PersistentFlags().Uint64Var(&seed, "seed", 0, "Seed of the --random-user-agent picks, to reproduce a run (default random)")
+	rootCmd.PersistentFlags().UintVar(&maxRequests, "max-requests", 0, "Stop after sending this many requests to the API, retries included (0 = unlimited)")
+	rootCmd.PersistentFlags().UintVar(&maxRetries, "max-retries", 3, "Maximum retries of a request on connection errors and 5xx responses")
+	rootCmd.PersistentFlags().UintVar(&backoffAfter, "backoff-after", 3, "Double the repetition interval after this many checks in a row fail completely (0 disables)")
+	rootCmd.PersistentFlags().StringVar(&maxBackoffInterval, "max-backoff-interval", "30m", "Longest repetition interval the backoff stretches to")
+	rootCmd.PersistentFlags().UintVar(&breakerThreshold, "breaker-threshold", 0, "Stop sending requests for --breaker-cooldown after this many failed requests within --breaker-window (0 disables)")
+	rootCmd.PersistentFlags().StringVar(&breakerWindow, "breaker-window", "5m", "Window in which the failed requests are counted for --breaker-threshold")
+	rootCmd.PersistentFlags().StringVar(&breakerCooldown, "breaker-cooldown", "10m", "How long the circuit breaker stays open before a test request")
+	rootCmd.PersistentFlags().BoolVar(&notifyErrors, "notify-errors", false, "Notify via Telegram when requests keep failing (at most once per 30 minutes)")
+	rootCmd.PersistentFlags().UintVar(&maxNotificationsPerDay, "max-notifications-per-day", 0, "Send at most this many flight notifications in 24 hours (0 means no limit)")
+	rootCmd.PersistentFlags().StringVar(&notifyCooldown, "notify-cooldown", "", "Don't notify a flight again within this duration (e.g. 6h), even if it reappears")
+	rootCmd.PersistentFlags().StringVar(&summaryInterval, "summary-interval", "", "Send one digest of the flights found in each window of this duration (e.g. 6h) instead of a notification per change")
+	rootCmd.PersistentFlags().StringVar(&latencyStatsInterval, "latency-stats-interval", "", "Also log the API latency statistics at this interval (e.g. 1h), not only when stopping")
+	rootCmd.PersistentFlags().BoolVar(&notifyRemovals, "notify-removals", false, "Also notify when previously available flights are no longer available")
+	rootCmd.PersistentFlags().StringVar(&instanceName, "instance-name", DefaultInstanceName, "Name heading the notifications, to tell several bots apart")
+	rootCmd.PersistentFlags().BoolVar(&compact, "compact", false, "Send a line per flight, like \"NAJ→BAK 2025-06-01 08:30 (149 AZN)\", for push notification previews")
+	rootCmd.PersistentFlags().StringVar(&messageTemplate, "message-template", "", "Go text/template for the flight notifications, inline or @file")
+	rootCmd.PersistentFlags().StringVar(&bookingURLTemplate, "booking-url-template", "", "Go text/template for the booking links, over .From, .To, .Date, .ReturnDate, .TripType, .Adults, .Children, .Infants, .InfantsWithSeat, .Currency and .Lang")
+	rootCmd.PersistentFlags().BoolVar(&outputJSON, "output-json", false, "Print the available flights of each check to stdout as one JSON object per line (logs stay on stderr)")
+	rootCmd.PersistentFlags().BoolVar(&printDeeplink, "print-deeplink", false, "Print the azal.az booking link of each route and day, then exit")
+	rootCmd.PersistentFlags().BoolVar(&testNotify, "test-notify", false, "Send a test flight notification (route TEST-TEST) at startup")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Print the notifications to stdout instead of sending them")
+	rootCmd.PersistentFlags().BoolVar(&once, "once", false, "Check once and exit (0: flights found, 2: no flights, 3: request error)")
+	rootCmd.PersistentFlags().BoolVar(&warmupNoNotify, "warmup-no-notify", false, "Don't notify the flights found by the first check, only the changes after it")
+	rootCmd.PersistentFlags().BoolVar(&exitOnFirstMatch, "exit-on-first-match", false, "Poll until flights are found, notify them and exit (4: nothing found before --duration/--until)")
+	rootCmd.PersistentFlags().BoolVar(&failFast, "fail-fast", false, "Exit with 5 at the first request error that retrying can't fix, like a 4xx response")
+	rootCmd.PersistentFlags().StringVar(&proxy, "proxy", "", "Proxy URL for the flight search requests (http, https or socks5); defaults to HTTPS_PROXY")
+	rootCmd.PersistentFlags().BoolVar(&disableHTTP2, "disable-http2", false, "Use HTTP/1.1 for the flight search requests, for proxies or servers that misbehave with HTTP/2")
+	rootCmd.PersistentFlags().BoolVar(&disableKeepAlive, "disable-keepalive", false, "Open a new connection for every flight search request")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Log level: error, warn, info or debug")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Also write the logs (without colors) to this file")
+	rootCmd.PersistentFlags().UintVar(&logMaxSize, "log-max-size", 10, "Rotate the log file when it reaches this size in MB")
+	rootCmd.PersistentFlags().UintVar(&logBackups, "log-backups", 3, "Number of rotated log files to keep")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Log at the debug level (same as --log-level debug)")
+	rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "Disable colored output")
+	rootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on (e.g. :9090)")
+	rootCmd.PersistentFlags().StringVar(&healthAddr, "health-addr", "", "Address to serve the /healthz liveness endpoint on (e.g. :8080)")
+	rootCmd.PersistentFlags().StringVar(&csvFile, "csv-file", "", "Append the found flights to this CSV file")
+	rootCmd.PersistentFlags().StringVar(&stateFile, "state-file", "", "Path to a JSON file that keeps the seen flights across restarts")
+	rootCmd.PersistentFlags().BoolVar(&noStartNotification, "no-start-notification", false, "Don't send the Telegram start notification")
+	rootCmd.PersistentFlags().BoolVar(&dailyStartNotification, "daily-start-notification", false, "Send the Telegram start notification at most once a day, even across restarts (needs --state-file)")
+	rootCmd.PersistentFlags().BoolVar(&trace, "trace", false, "Log every flight search request and its raw response, and the Telegram requests, with the secrets redacted")
+	rootCmd.PersistentFlags().StringVar(&dumpResponses, "dump-responses", "", "Directory to write the raw API response bodies to, for debugging")
+	rootCmd.PersistentFlags().StringVarP(&repetInterval, "repet-interval", "r", "60", "Repetition interval as a duration (e.g. 90s, 5m) or bare seconds")
+	rootCmd.PersistentFlags().UintVar(&jitter, "jitter", 0, "Randomize the repetition interval by up to this percentage")
+	rootCmd.PersistentFlags().Uint32Var(&requestTimeout, "request-timeout", 30, "Timeout of a single flight search request in seconds")
+	rootCmd.PersistentFlags().StringVar(&duration, "duration", "", "Stop after running this long, e.g. 6h")
+	rootCmd.PersistentFlags().StringVar(&until, "until", "", "Stop at this time, format '2006-01-02T15:04:05' or '2006-01-02'")
+	rootCmd.PersistentFlags().StringVar(&quietHours, "quiet-hours", "", "Daily window like 22:00-07:00 (in --timezone) without notifications; flight changes are sent after it")
+
+	// Advanced: point the bot at a staging endpoint, a mock server or an API gateway.
+	rootCmd.PersistentFlags().StringVar(&apiURL, "api-url", azal.RequestURL, "Flight search API URL")
+	rootCmd.PersistentFlags().StringVar(&telegramAPIURL, "telegram-api-url", TelegramAPIURL, "Telegram Bot API base URL")
+	rootCmd.PersistentFlags().StringVar(&apiAuthValue, "api-auth-value", "", "Authorization header value sent with the flight search requests, e.g. 'Basic dXNlcjpwYXNz'")
+	rootCmd.PersistentFlags().StringVar(&bearerToken, "bearer-token", "", "Send the flight search requests with 'Authorization: Bearer <token>'")
+	rootCmd.PersistentFlags().MarkHidden("api-url")
+	rootCmd.PersistentFlags().MarkHidden("telegram-api-url")
+	rootCmd.PersistentFlags().MarkHidden("api-auth-value")
+	rootCmd.PersistentFlags().MarkHidden("bearer-token")
+	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to a YAML config file (flags override its values)")
+
+	cmd, err := rootCmd.ExecuteC()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		switch flag.Name {
+		case "version":
+			os.Exit(0)
+		case "help":
+			os.Exit(0)
+		}
+	})
+
+	return userInput
+}
+
+// newTransport returns the transport used for the flight search requests.
+// Without an explicit proxy, HTTPS_PROXY and the other proxy environment variables are honored.
+func newTransport(proxy *url.URL, disableHTTP2, disableKeepAlive bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	if disableHTTP2 {
+		// A non-nil empty TLSNextProto keeps the transport from upgrading to HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	transport.DisableKeepAlives = disableKeepAlive
+	return transport
+}
+
+// checkProxy verifies that the proxy used for apiURL, if any, accepts connections.
+func checkProxy(transport *http.Transport, apiURL string) error {
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return err
+	}
+	proxy, err := transport.Proxy(req)
+	if err != nil || proxy == nil {
+		return err
+	}
+	host := proxy.Host
+	if proxy.Port() == "" {
+		port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxy.Scheme]
+		host = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("proxy %s is unreachable: %v", proxy.Redacted(), err)
+	}
+	return conn.Close()
+}
+
+// jitteredInterval returns a random duration within ±jitter percent of interval.
+func jitteredInterval(interval time.Duration, jitter uint) time.Duration {
+	if jitter == 0 {
+		return interval
+	}
+	spread := interval * time.Duration(jitter) / 100
+	return interval - spread + rand.N(2*spread+1)
+}
+
+// startBot polls until ctx is cancelled, the deadline is reached or, with Once, after the first check.
+func startBot(ctx context.Context, botConfig *BotConfig, ifAvailable, ifRemoved func(avialableFlights AvialableFlights) error, ifError func(err error) error) int {
+	queryConfs := botConfig.queryConfigs()
+	// The locale is sent both as the lang query and the x-locale header, so the API answers in one language.
+	headerConf := azal.HeaderConfig{XLocale: botConfig.Locale, Authorization: botConfig.APIAuthorization}
+	if botConfig.DisableKeepAlive {
+		headerConf.Connection = "close"
+	}
+	headerConf.SetDefaults()
+
+	// A single client is shared by every day and repetition so connections are pooled.
+	transport := newTransport(botConfig.Proxy, botConfig.DisableHTTP2, botConfig.DisableKeepAlive)
+	if err := checkProxy(transport, botConfig.APIURL); err != nil {
+		logger.Error(LogFields{Event: "proxy_unreachable"}, "Error: ", err.Error())
+	}
+	sendRequestClient := &http.Client{Timeout: botConfig.RequestTimeout, Transport: transport}
+	var circuitBreaker *CircuitBreaker
+	if botConfig.BreakerThreshold > 0 {
+		circuitBreaker = &CircuitBreaker{
+			Threshold: int(botConfig.BreakerThreshold),
+			Window:    botConfig.BreakerWindow,
+			Cooldown:  botConfig.BreakerCooldown,
+			OnChange: func(open bool, reason string) {
+				message := "Circuit breaker opened: " + reason
+				if open {
+					logger.Warn(LogFields{Event: "circuit_opened"}, message)
+				} else {
+					message = "Circuit breaker closed: " + reason
+					logger.Info(LogFields{Event: "circuit_closed"}, message)
+				}
+				if botConfig.NotifyErrors {
+					if err := ifError(errors.New(message)); err != nil {
+						logger.Error(LogFields{Event: "notification_failed"}, err.Error())
+					}
+				}
+			},
+		}
+	}
+	var (
+		previousFlights       AvialableFlights
+		consecutiveFailures   int
+		lastErrorNotification time.Time
+		// lastNotified holds when each flight (see flightIdentity) was last notified, for NotifyCooldown.
+		lastNotified = make(map[string]time.Time)
+		// intervalFactor stretches RepetInterval while the API keeps answering 429.
+		intervalFactor = 1
+		// failedPolls counts the consecutive checks in which every request failed;
+		// from BackoffAfter on, backoffFactor doubles the interval on each of them.
+		failedPolls   int
+		backoffFactor = 1
+		// notificationTimes are the flight notifications of the last 24 hours, for MaxNotificationsPerDay.
+		notificationTimes []time.Time
+		suppressed        int
+		// summaryFlights collects the flights found since summaryStart, for SummaryInterval.
+		summaryFlights = make(AvialableFlights)
+		summaryStart   = time.Now()
+	)
+	sendSummary := func() {
+		if len(summaryFlights) > 0 {
+			if err := ifAvailable(summaryFlights); err != nil {
+				logger.Error(LogFields{Event: "notification_failed"}, "Error: ", err.Error())
+			}
+		}
+		summaryFlights, summaryStart = make(AvialableFlights), time.Now()
+	}
+	logLatencyStats := func() {
+		if stats := latencyStats.String(); stats != "" {
+			logger.Info(LogFields{Event: "latency_stats"}, "API latency: ", stats)
+		}
+	}
+	defer logLatencyStats()
+	// stop ends the run before the next check, once the --max-requests budget is
+	// used up or the --duration/--until deadline is reached: it sends the last
+	// digest and tells through ifError that the bot stopped.
+	stop := func(event, message string, exitCode int) int {
+		logger.Info(LogFields{Event: event}, message)
+		if botConfig.SummaryInterval > 0 {
+			sendSummary()
+		}
+		if err := ifError(errors.New(message)); err != nil {
+			logger.Error(LogFields{Event: "notification_failed"}, err.Error())
+		}
+		if botConfig.ExitOnFirstMatch {
+			return ExitCodeNoMatch
+		}
+		return exitCode
+	}
+	// stopForBudget ends the run once the --max-requests budget is used up.
+	stopForBudget := func(exitCode int) int {
+		return stop("budget_exhausted", fmt.Sprintf("Request budget exhausted after %d request(s), stopping", requestBudget.Max), exitCode)
+	}
+	if botConfig.LatencyStatsInterval > 0 && !botConfig.Once {
+		go func() {
+			ticker := time.NewTicker(botConfig.LatencyStatsInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					logLatencyStats()
+				}
+			}
+		}()
+	}
+	// search is a single request of a poll: a route on a day. unit is the index
+	// of its route in searchRoutes, the routes that are scheduled on their own.
+	type search struct {
+		route     Route
+		day       string
+		queryConf azal.QueryConfig
+		isReturn  bool
+		unit      int
+	}
+	var searches []search
+	searchRoutes := slices.Clone(botConfig.Routes)
+	for _, day := range botConfig.days {
+		for i, route := range botConfig.Routes {
+			queryConf := queryConfs[i]
+			queryConf.DepartureDate = day
+			searches = append(searches, search{route: route, day: day, queryConf: queryConf, unit: i})
+		}
+	}
+	if botConfig.ReturnRoute != nil {
+		searchRoutes = append(searchRoutes, *botConfig.ReturnRoute)
+		// A return route that isn't the reversed outbound one is searched on its own as a one way trip.
+		returnDay := botConfig.ReturnDate.Format("2006-01-02")
+		queryConf := queryConfs[0]
+		queryConf.From, queryConf.To = botConfig.ReturnRoute.From, botConfig.ReturnRoute.To
+		queryConf.DepartureDate = returnDay
+		searches = append(searches, search{route: *botConfig.ReturnRoute, day: returnDay, queryConf: queryConf, isReturn: true, unit: len(searchRoutes) - 1})
+	}
+	var (
+		// With RouteIntervals each route is polled when it is due at nextPoll (zero
+		// means now); the flights of the routes not polled in a check are carried
+		// over from lastPoll, so they aren't taken as removed.
+		nextPoll  = make([]time.Time, len(searchRoutes))
+		lastPoll  = make(AvialableFlights)
+		lastUnits = make(map[string]int)
+	)
+	var startNotified time.Time
+	// warmedUp is set by the first check that reached the API when WarmupNoNotify is set.
+	warmedUp := !botConfig.WarmupNoNotify
+	if botConfig.StateFile != "" {
+		state, err := loadState(botConfig.StateFile)
+		if err != nil {
+			logger.Warn(LogFields{Event: "state_load_failed"}, "Warning: could not load state file, starting fresh: ", err.Error())
+		} else {
+			previousFlights, startNotified = state.Flights, state.StartNotified
+			lastPoll = state.Flights
+		}
+	}
+	for {
+		var (
+			mu               sync.Mutex
+			wg               sync.WaitGroup
+			avialableFlights = make(AvialableFlights)
+			returnCollected  = make(map[string]bool)
+			requestFailed    bool
+			pollSucceeded    bool
+			// unrecoverable is the first error isUnrecoverable with FailFast; the rest of the check is skipped.
+			unrecoverable error
+			jobs          = make(chan func())
+			pollStart     = time.Now()
+			// outOfBudget is set when a search was skipped because the request budget ran out.
+			outOfBudget bool
+			// flightUnits holds the search unit that found each key of avialableFlights.
+			flightUnits = make(map[string]int)
+			// failedKeys are the keys whose search failed; their flights are carried
+			// over from lastPoll, so a failed request isn't taken as the flights being removed.
+			failedKeys []string
+		)
+		due := func(unit int) bool { return !pollStart.Before(nextPoll[unit]) }
+		for key, flights := range lastPoll {
+			if unit := lastUnits[key]; !due(unit) {
+				avialableFlights[key], flightUnits[key] = flights, unit
+			}
+		}
+		for range botConfig.Concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					job()
+				}
+			}()
+		}
+		for _, search := range searches {
+			if !due(search.unit) {
+				continue
 			}
-			last, err := time.Parse("2006-01-02T15:04:05", lastDate)
-			if err != nil {
-				last, err = time.Parse("2006-01-02", lastDate)
+			route, day, queryConf := search.route, search.day, search.queryConf
+			jobs <- func() {
+				mu.Lock()
+				skip := unrecoverable != nil
+				mu.Unlock()
+				if skip {
+					return
+				}
+				routeDay := flightKey(route, day, search.isReturn)
+				searchKeys := []string{routeDay}
+				if queryConf.ReturnDate != "" {
+					searchKeys = append(searchKeys, flightKey(Route{From: route.To, To: route.From}, queryConf.ReturnDate, true))
+				}
+				fields := LogFields{Route: route.String(), Day: day}
+				data, err := circuitBreaker.sendRequest(ctx, sendRequestClient, botConfig.APIURL, &queryConf, &headerConf, botConfig.MaxRetries)
 				if err != nil {
-					fmt.Printf("Error: parsing LastDate: %v\n", err)
-					cmd.Help()
-					os.Exit(1)
+					if ctx.Err() != nil {
+						// The bot is stopping, the request was cancelled.
+						return
+					}
+					switch err {
+					case azal.ErrorNoFlightsAvailable:
+						metrics.NoFlights.Inc()
+						health.recordRequest(true)
+						mu.Lock()
+						consecutiveFailures = 0
+						pollSucceeded = true
+						mu.Unlock()
+						fields.Event = "no_flights"
+						logger.Debug(fields, "No flights available for ", routeDay)
+					case ErrorCircuitOpen:
+						mu.Lock()
+						requestFailed = true
+						failedKeys = append(failedKeys, searchKeys...)
+						mu.Unlock()
+						fields.Event = "circuit_open"
+						logger.Debug(fields, "Circuit breaker open, skipping ", routeDay)
+					case ErrorBudgetExhausted:
+						mu.Lock()
+						outOfBudget = true
+						mu.Unlock()
+						fields.Event = "budget_exhausted"
+						logger.Debug(fields, "Request budget exhausted, skipping ", routeDay)
+					case azal.ErrorFlowInterrupted:
+						metrics.RequestErrors.Inc()
+						health.recordRequest(false)
+						mu.Lock()
+						requestFailed = true
+						mu.Unlock()
+						fields.Event = "date_passed"
+						logger.Error(fields, "The date entered has passed: ", routeDay)
+						if err := ifError(fmt.Errorf("the date entered has passed: %s", routeDay)); err != nil {
+							logger.Error(LogFields{Event: "notification_failed"}, err.Error())
+						}
+					default:
+						metrics.RequestErrors.Inc()
+						health.recordRequest(false)
+						mu.Lock()
+						requestFailed = true
+						failedKeys = append(failedKeys, searchKeys...)
+						if botConfig.FailFast && unrecoverable == nil && isUnrecoverable(err) {
+							unrecoverable = fmt.Errorf("%s: %w", routeDay, err)
+						}
+						consecutiveFailures++
+						failures := consecutiveFailures
+						notify := botConfig.NotifyErrors && failures >= ErrorNotifyThreshold &&
+							time.Since(lastErrorNotification) >= ErrorNotifyInterval
+						if notify {
+							lastErrorNotification = time.Now()
+						}
+						mu.Unlock()
+						fields.Event = "request_failed"
+						logger.Error(fields, err.Error())
+						if notify {
+							if err := ifError(fmt.Errorf("%d consecutive requests failed, last error: %v", failures, err)); err != nil {
+								logger.Error(LogFields{Event: "notification_failed"}, err.Error())
+							}
+						}
+					}
+					return
+				}
+				health.recordRequest(true)
+				mu.Lock()
+				consecutiveFailures = 0
+				pollSucceeded = true
+				mu.Unlock()
+
+				for _, warning := range data.Warnings {
+					fields.Event = "api_warning"
+					logger.Warn(fields, "API warning for ", routeDay, ": ", warning.String())
+				}
+				if len(data.Search.OptionSets) == 0 {
+					metrics.NoFlights.Inc()
+					fields.Event = "no_flights"
+					logger.Debug(fields, "No flights available for ", routeDay)
+					return
+				}
+				options, duplicates := uniqueOptions(data.Search.OptionSets[0].Options)
+				if duplicates > 0 {
+					fields.Event = "duplicate_options"
+					logger.Debug(fields, "Dropped ", duplicates, " repeated flight(s) in the response for ", routeDay)
+				}
+				flights := botConfig.collectFlights(data, route, &queryConf, options, fields, search.isReturn)
+				mu.Lock()
+				if len(flights) > 0 {
+					avialableFlights[routeDay], flightUnits[routeDay] = flights, search.unit
+				}
+				mu.Unlock()
+
+				if queryConf.ReturnDate == "" || len(data.Search.OptionSets) < 2 {
+					return
 				}
-				last = last.AddDate(0, 0, 1)
-				last = last.Add(-time.Second)
+				// The return leg is the same for every outbound day, so collect it only once per poll.
+				returnRoute := Route{From: route.To, To: route.From}
+				returnKey := flightKey(returnRoute, queryConf.ReturnDate, true)
+				mu.Lock()
+				collected := returnCollected[returnKey]
+				returnCollected[returnKey] = true
+				mu.Unlock()
+				if collected {
+					return
+				}
+				returnFields := LogFields{Route: returnRoute.String(), Day: queryConf.ReturnDate}
+				returnQueryConf := queryConf
+				returnQueryConf.From, returnQueryConf.To = returnRoute.From, returnRoute.To
+				returnQueryConf.DepartureDate, returnQueryConf.ReturnDate = queryConf.ReturnDate, ""
+				returnQueryConf.TripType = "OW"
+				returnOptions, duplicates := uniqueOptions(data.Search.OptionSets[1].Options)
+				if duplicates > 0 {
+					returnFields.Event = "duplicate_options"
+					logger.Debug(returnFields, "Dropped ", duplicates, " repeated return flight(s) in the response for ", returnKey)
+				}
+				returnFlights := botConfig.collectFlights(data, returnRoute, &returnQueryConf, returnOptions, returnFields, true)
+				mu.Lock()
+				if len(returnFlights) > 0 {
+					avialableFlights[returnKey], flightUnits[returnKey] = returnFlights, search.unit
+				}
+				mu.Unlock()
 			}
-			if first.After(last) || first.Equal(last) {
-				fmt.Println("Error: first date should be before last date and they should not be equal")
-				cmd.Help()
-				os.Exit(1)
+		}
+		close(jobs)
+		wg.Wait()
+		if ctx.Err() != nil {
+			// A check cut short by the shutdown is incomplete, don't notify it.
+			return ExitCodeRequestError
+		}
+		if outOfBudget {
+			// The searches over the budget were skipped, so the check is incomplete; don't notify it.
+			return stopForBudget(ExitCodeRequestError)
+		}
+		for _, key := range failedKeys {
+			if flights, ok := lastPoll[key]; ok && avialableFlights[key] == nil {
+				avialableFlights[key], flightUnits[key] = flights, lastUnits[key]
 			}
-			if repetInterval < 1 {
-				fmt.Println("Error: repetInterval should be greater than 0")
-				cmd.Help()
-				os.Exit(1)
+		}
+		lastPoll, lastUnits = avialableFlights, flightUnits
+		if unrecoverable != nil {
+			logger.Error(LogFields{Event: "fail_fast"}, "Unrecoverable error, stopping: ", unrecoverable.Error())
+			if err := ifError(unrecoverable); err != nil {
+				logger.Error(LogFields{Event: "notification_failed"}, err.Error())
 			}
-			if len(from) > 5 || len(from) < 2 {
-				fmt.Println("Error: from should be between 2 and 5 characters")
-				cmd.Help()
-				os.Exit(1)
+			return ExitCodeUnrecoverable
+		}
+		if pollSucceeded {
+			health.recordSuccessfulPoll()
+		}
+
+		if botConfig.OutputJSON {
+			if err := printPollOutput(avialableFlights); err != nil {
+				logger.Error(LogFields{Event: "output_failed"}, "Error: writing the JSON output: ", err.Error())
 			}
-			if len(to) > 5 || len(to) < 2 {
-				fmt.Println("Error: to should be between 2 and 5 characters")
-				cmd.Help()
-				os.Exit(1)
+		}
+
+		// Notify only when the set of available flights differs from the previous check.
+		// During quiet hours previousFlights is kept as the last notified result, so the
+		// changes are sent together at the first check after the window.
+		added, removed := DiffFlights(previousFlights, avialableFlights)
+		// The warmup check only records the flights, so the next checks notify the changes
+		// from now on. A check where every request failed doesn't count as the warmup.
+		warmup := !warmedUp
+		if warmup {
+			previousFlights = avialableFlights
+			added, removed = nil, nil
+			if pollSucceeded {
+				warmedUp = true
+				logger.Info(
+					LogFields{Event: "warmup"},
+					fmt.Sprintf("Warmup check found %d flight day(s), notifying only the changes from now on", len(avialableFlights)),
+				)
 			}
-			if telegramBotKey != "" {
-				if telegramChatID == "" {
-					fmt.Println("Error: telegramChatID is required if telegramBotKey is provided")
-					cmd.Help()
-					os.Exit(1)
+		} else if (len(added) > 0 || len(removed) > 0) && botConfig.QuietHours.contains(time.Now()) {
+			logger.Debug(LogFields{Event: "quiet_hours"}, "Quiet hours, holding back the notification until the window ends")
+			added, removed = nil, nil
+		} else {
+			previousFlights = avialableFlights
+		}
+		notify := len(added) > 0 || len(removed) > 0
+		if botConfig.NotifyCooldown > 0 {
+			// Only flights not notified within the cooldown trigger a notification,
+			// so a flight flapping in and out of availability stays quiet.
+			now := time.Now()
+			for identity, notifiedAt := range lastNotified {
+				if now.Sub(notifiedAt) >= botConfig.NotifyCooldown {
+					delete(lastNotified, identity)
 				}
 			}
-			if telegramChatID != "" {
-				if telegramBotKey == "" {
-					fmt.Println("Error: telegramBotKey is required if telegramChatID is provided")
-					cmd.Help()
-					os.Exit(1)
+			notify = false
+			for key, flights := range added {
+				for _, flight := range flights {
+					if _, ok := lastNotified[flightIdentity(key, flight)]; !ok {
+						notify = true
+					}
 				}
 			}
-
-			userInput.FirstDate = first
-			userInput.LastDate = last
-			userInput.From = from
-			userInput.To = to
-			userInput.TelegramBotKey = telegramBotKey
-			userInput.TelegramChatID = telegramChatID
-			userInput.RepetInterval = time.Duration(repetInterval) * time.Second
-		},
+			if notify {
+				for key, flights := range avialableFlights {
+					for _, flight := range flights {
+						lastNotified[flightIdentity(key, flight)] = now
+					}
+				}
+			} else if len(added) > 0 {
+				logger.Debug(LogFields{Event: "notify_cooldown"}, "Flights were notified within the cooldown, skipping the notification")
+			}
+		}
+		if notify && botConfig.MaxNotificationsPerDay > 0 {
+			cutoff := time.Now().Add(-24 * time.Hour)
+			notificationTimes = slices.DeleteFunc(notificationTimes, func(t time.Time) bool { return t.Before(cutoff) })
+			if len(notificationTimes) >= int(botConfig.MaxNotificationsPerDay) {
+				suppressed++
+				notify = false
+				logger.Info(LogFields{Event: "notification_limit"}, "Daily notification limit reached, not sending the notification")
+			} else {
+				notificationTimes = append(notificationTimes, time.Now())
+			}
+		}
+		if botConfig.SummaryInterval > 0 && !warmup {
+			// In summary mode the flights found by all the checks of a window are sent
+			// together once the window is over, instead of a notification per change.
+			summaryFlights.merge(avialableFlights)
+			notify = false
+			if time.Since(summaryStart) >= botConfig.SummaryInterval && !botConfig.QuietHours.contains(time.Now()) {
+				sendSummary()
+			}
+		}
+		// With ExitOnFirstMatch the first flights found are always notified, as the bot
+		// exits right after. During quiet hours it keeps polling until the window ends.
+		// After a warmup only flights that weren't there at the warmup count.
+		firstMatch := botConfig.ExitOnFirstMatch && avialableFlights.bookable() && !botConfig.QuietHours.contains(time.Now()) &&
+			!warmup && (!botConfig.WarmupNoNotify || added.bookable())
+		if firstMatch {
+			notify = true
+		}
+		for key, flights := range added {
+			for i, flight := range avialableFlights[key] {
+				avialableFlights[key][i].New = slices.ContainsFunc(flights, func(f AvialableFlight) bool { return sameFlight(f, flight) })
+			}
+		}
+		if notify {
+			suppressedNotifications = suppressed
+			if err := ifAvailable(avialableFlights); err != nil {
+				logger.Error(LogFields{Event: "notification_failed"}, "Error: ", err.Error())
+			}
+			suppressed, suppressedNotifications = 0, 0
+		}
+		if len(removed) > 0 && ifRemoved != nil {
+			if err := ifRemoved(removed); err != nil {
+				logger.Error(LogFields{Event: "notification_failed"}, "Error: ", err.Error())
+			}
+		}
+		if botConfig.StateFile != "" {
+			if err := saveState(botConfig.StateFile, &State{Flights: previousFlights, StartNotified: startNotified}); err != nil {
+				logger.Error(LogFields{Event: "state_save_failed"}, "Error: saving state file: ", err.Error())
+			}
+		}
+		exitCode := ExitCodeNoFlights
+		switch {
+		case avialableFlights.bookable():
+			exitCode = ExitCodeFlightsFound
+		case requestFailed:
+			exitCode = ExitCodeRequestError
+		}
+		if botConfig.Once {
+			return exitCode
+		}
+		if firstMatch {
+			logger.Info(LogFields{Event: "first_match"}, "Flights found, stopping")
+			return ExitCodeFlightsFound
+		}
+		if requestBudget.exhausted() {
+			return stopForBudget(exitCode)
+		}
+		if rateLimit.takeLimited() {
+			intervalFactor = min(intervalFactor*2, MaxIntervalFactor)
+			logger.Warn(LogFields{Event: "rate_limited"}, "Rate limited by the API, repetition interval is now ", botConfig.RepetInterval*time.Duration(intervalFactor))
+		} else if intervalFactor > 1 {
+			intervalFactor /= 2
+		}
+		interval := botConfig.RepetInterval * time.Duration(intervalFactor)
+		if requestFailed && !pollSucceeded {
+			failedPolls++
+		} else {
+			if backoffFactor > 1 {
+				logger.Info(LogFields{Event: "backoff_reset"}, "The API is reachable again, repetition interval is back to ", interval)
+			}
+			failedPolls, backoffFactor = 0, 1
+		}
+		if botConfig.BackoffAfter > 0 && failedPolls >= int(botConfig.BackoffAfter) {
+			if interval*time.Duration(backoffFactor) < botConfig.MaxBackoffInterval {
+				backoffFactor *= 2
+			}
+			interval = min(interval*time.Duration(backoffFactor), max(botConfig.MaxBackoffInterval, interval))
+			logger.Warn(LogFields{Event: "backoff"}, fmt.Sprintf("%d check(s) in a row failed, repetition interval is now %s", failedPolls, interval))
+		}
+		wait := jitteredInterval(interval, botConfig.Jitter)
+		if len(botConfig.RouteIntervals) > 0 {
+			// Rate limiting and the backoff stretch the routes' own intervals like the global one.
+			stretch := float64(interval) / float64(botConfig.RepetInterval)
+			now := time.Now()
+			for unit, route := range searchRoutes {
+				if !due(unit) {
+					continue
+				}
+				nextPoll[unit] = now.Add(wait)
+				if routeInterval, ok := botConfig.RouteIntervals[route.String()]; ok {
+					nextPoll[unit] = now.Add(jitteredInterval(time.Duration(float64(routeInterval)*stretch), botConfig.Jitter))
+				}
+			}
+			wait = max(time.Until(slices.MinFunc(nextPoll, func(a, b time.Time) int { return a.Compare(b) })), 0)
+		}
+		if !botConfig.Deadline.IsZero() {
+			if remaining := time.Until(botConfig.Deadline); remaining < wait {
+				if !sleepContext(ctx, max(remaining, 0)) {
+					return exitCode
+				}
+				return stop("deadline_reached", "Deadline reached, stopping", exitCode)
+			}
+		}
+		if !sleepContext(ctx, wait) {
+			return exitCode
+		}
 	}
+}
 
-	rootCmd.Flags().StringVarP(&firstDate, "first-date", "i", "", "First date in format '2006-01-02T15:04:05'")
-	rootCmd.Flags().StringVarP(&lastDate, "last-date", "l", "", "Last date in format '2006-01-02T15:04:05'")
-	rootCmd.Flags().StringVarP(&from, "from", "f", "", "From where you want to fly (e.g. NAJ)")
-	rootCmd.Flags().StringVarP(&to, "to", "t", "", "To where you want to fly (e.g. BAK)")
-	rootCmd.Flags().StringVar(&telegramBotKey, "telegram-bot-key", "", "Telegram bot key")
-	rootCmd.Flags().StringVar(&telegramChatID, "telegram-chat-id", "", "Telegram chat id")
-	rootCmd.Flags().Uint32VarP(&repetInterval, "repet-interval", "r", 60, "Repetition interval in seconds")
-
-	rootCmd.MarkFlagRequired("first-date")
-	rootCmd.MarkFlagRequired("last-date")
-	rootCmd.MarkFlagRequired("from")
-	rootCmd.MarkFlagRequired("to")
-
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// withFallback returns a notifier that sends through primary and, only if that
+// fails, through fallback. Which of the two delivered the notification is logged.
+func withFallback(primaryName, fallbackName string, primary, fallback func(avialableFlights AvialableFlights) error) func(avialableFlights AvialableFlights) error {
+	return func(avialableFlights AvialableFlights) error {
+		err := primary(avialableFlights)
+		if err == nil {
+			logger.Debug(LogFields{Event: "notification_delivered"}, "Notification delivered through the primary backend ", primaryName)
+			return nil
+		}
+		logger.Warn(LogFields{Event: "notification_fallback"}, "Primary backend ", primaryName, " failed, sending through ", fallbackName, ": ", err.Error())
+		if fallbackErr := fallback(avialableFlights); fallbackErr != nil {
+			return errors.Join(fmt.Errorf("%s: %w", primaryName, err), fmt.Errorf("%s: %w", fallbackName, fallbackErr))
+		}
+		logger.Info(LogFields{Event: "notification_delivered"}, "Notification delivered through the fallback backend ", fallbackName)
+		return nil
 	}
+}
 
-	rootCmd.Flags().Visit(func(flag *pflag.Flag) {
-		switch flag.Name {
-		case "version":
-			os.Exit(0)
-		case "help":
-			os.Exit(0)
+// sendTestNotification sends a made-up flight on the TEST-TEST route through the
+// notifiers, so a broken backend or template shows up before a real flight appears.
+func sendTestNotification(botConfig *BotConfig, notifiers []func(avialableFlights AvialableFlights) error) error {
+	route := botConfig.Routes[0]
+	queryConf := azal.QueryConfig{From: route.From, To: route.To, DepartureDate: botConfig.days[0]}
+	queryConf.SetDefaults()
+	testFlights := AvialableFlights{
+		flightKey(Route{From: "TEST", To: "TEST"}, botConfig.days[0], false): {{
+			Economy:       true,
+			EconomyPrice:  &azal.Price{Amount: 1, Currency: botConfig.Currency},
+			DepartureDate: botConfig.FirstDate,
+			BookingURL:    flightBookingURL(&queryConf),
+		}},
+	}
+	var errs []error
+	for _, notify := range notifiers {
+		if err := notify(testFlights); err != nil {
+			errs = append(errs, err)
 		}
-	})
+	}
+	return errors.Join(errs...)
+}
 
-	return userInput
+// TelegramChat is a chat as the Bot API returns it, for the telegram-chat-id command.
+type TelegramChat struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
 }
 
-func startBot(botConfig *BotConfig, ifAvailable func(avialableFlights AvialableFlights) error, ifError func(err error) error) {
-	queryConf := QueryConfig{
-		From: botConfig.From,
-		To:   botConfig.To,
+// name is the title of a group or channel, or the name of a person, with the username if any.
+func (chat TelegramChat) name() string {
+	name := chat.Title
+	if name == "" {
+		name = strings.TrimSpace(chat.FirstName + " " + chat.LastName)
 	}
-	queryConf.setDefaults()
-	headerConf := HeaderConfig{}
-	headerConf.setDefaults()
+	if chat.Username != "" {
+		name = strings.TrimSpace(name + " (@" + chat.Username + ")")
+	}
+	return name
+}
 
-	sendRequestClient := &http.Client{}
-	for {
-		avialableFlights := make(AvialableFlights)
-		for _, day := range botConfig.days {
-			queryConf.DepartureDate = day
-			data, err := sendRequest(sendRequestClient, &queryConf, &headerConf)
-			if err != nil {
-				switch err {
-				case ErrorNoFlightsAvailable:
-					log.Println(Colored(Colors.Yellow, "No flights available for ", day))
-				case ErrorFlowInterrupted:
-					log.Println(Colored(Colors.Red, "The date entered has passed: ", day))
-					if err := ifError(fmt.Errorf("the date entered has passed: %s", day)); err != nil {
-						log.Println(Colored(Colors.Red, err.Error()))
-					}
-				default:
-					log.Println(Colored(Colors.Red, err.Error()))
-				}
+// recentChats returns the chats of the updates the bot received recently, each
+// once, in the order they first appear. Telegram keeps the updates for 24 hours.
+func (telegramRequest *TelegramRequest) recentChats() ([]TelegramChat, error) {
+	type update struct {
+		Message       *struct{ Chat TelegramChat } `json:"message"`
+		EditedMessage *struct{ Chat TelegramChat } `json:"edited_message"`
+		ChannelPost   *struct{ Chat TelegramChat } `json:"channel_post"`
+		MyChatMember  *struct{ Chat TelegramChat } `json:"my_chat_member"`
+	}
+	var updates []update
+	if err := telegramRequest.callTelegram("getUpdates", url.Values{}, &updates); err != nil {
+		return nil, err
+	}
+	var chats []TelegramChat
+	seen := make(map[int64]bool)
+	for _, update := range updates {
+		for _, message := range []*struct{ Chat TelegramChat }{update.Message, update.EditedMessage, update.ChannelPost, update.MyChatMember} {
+			if message == nil || seen[message.Chat.ID] {
 				continue
 			}
+			seen[message.Chat.ID] = true
+			chats = append(chats, message.Chat)
+		}
+	}
+	return chats, nil
+}
 
-			if len(data.Warnings) > 0 {
-				log.Println(Colored(Colors.Yellow, "No flights available for ", day))
-				continue
-			}
-			for _, option := range data.Search.OptionSets[0].Options {
-				departureDate := option.Route.DepartureDate
-				if (departureDate.After(botConfig.FirstDate) || departureDate.Equal(botConfig.FirstDate)) &&
-					(departureDate.Before(botConfig.LastDate) || departureDate.Equal(botConfig.LastDate)) {
-
-					avialableFlights[day] = append(
-						avialableFlights[day],
-						AvialableFlight{
-							Economy:       option.CheapestEconomySolutionId != "",
-							Business:      option.CheapestBusinessSolutionId != "",
-							DepartureDate: departureDate.Time,
-						},
-					)
-					classes := ""
-					if option.CheapestEconomySolutionId != "" {
-						classes += "Economy"
-					}
-					if option.CheapestBusinessSolutionId != "" {
-						if classes != "" {
-							classes += ", "
-						}
-						classes += "Business"
-					}
-					log.Println(Colored(Colors.Green, "Flight available for ", departureDate, " (" + classes + ")"))
-				} else {
-					log.Println(Colored(Colors.Yellow, "No flights available for ", departureDate))
-				}
-			}
+// printTelegramChats prints the recent chats of the bot for the telegram-chat-id
+// command and reports whether any were found.
+func printTelegramChats(telegramRequest *TelegramRequest) bool {
+	chats, err := telegramRequest.recentChats()
+	if err != nil {
+		fmt.Printf("Error: telegram: %v\n", err)
+		return false
+	}
+	if len(chats) == 0 {
+		fmt.Println("No recent messages found. Send a message to the bot, or add it to the group or channel and post there, then run this again.")
+		return false
+	}
+	width := len("Chat ID")
+	for _, chat := range chats {
+		width = max(width, len(strconv.FormatInt(chat.ID, 10)))
+	}
+	fmt.Printf("%-*s  %-10s  %s\n", width, "Chat ID", "Type", "Name")
+	for _, chat := range chats {
+		fmt.Printf("%-*d  %-10s  %s\n", width, chat.ID, chat.Type, chat.name())
+	}
+	return true
+}
+
+// testBackends sends the test notification through each backend on its own and
+// prints a table of the results. A backend whose startup check failed (in
+// checkErrors) isn't sent to. It reports whether every backend succeeded.
+func testBackends(botConfig *BotConfig, names []string, notifiers []func(avialableFlights AvialableFlights) error, checkErrors map[string]error) bool {
+	width := len("Backend")
+	for _, name := range names {
+		width = max(width, len(name))
+	}
+	ok := true
+	fmt.Printf("%-*s  %s\n", width, "Backend", "Result")
+	for i, notify := range notifiers {
+		result := Colored(Colors.Green, "ok")
+		err := checkErrors[names[i]]
+		if err == nil {
+			err = sendTestNotification(botConfig, []func(avialableFlights AvialableFlights) error{notify})
 		}
-		if err := ifAvailable(avialableFlights); err != nil {
-			log.Println(Colored(Colors.Red, "Error: ", err.Error()))
+		if err != nil {
+			result = Colored(Colors.Red, "failed: ", err.Error())
+			ok = false
 		}
-		time.Sleep(botConfig.RepetInterval)
+		fmt.Printf("%-*s  %s\n", width, names[i], result)
 	}
+	return ok
 }
 
 func main() {
 	userInput := getUserInput()
+	logger.Format = userInput.LogFormat
+	logger.Level = userInput.LogLevel
+	if userInput.NoColor {
+		NoColor = true
+	}
+	var logFile *RotatingFile
+	if userInput.LogFile != "" {
+		var err error
+		logFile, err = openRotatingFile(userInput.LogFile, int64(userInput.LogMaxSize)<<20, int(userInput.LogBackups))
+		if err != nil {
+			fmt.Printf("Error: opening log file: %v\n", err)
+			os.Exit(1)
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, noColorWriter{logFile}))
+	}
 	botConfig := &BotConfig{
-		FirstDate:     userInput.FirstDate,
-		LastDate:      userInput.LastDate,
-		From:          userInput.From,
-		To:            userInput.To,
-		RepetInterval: userInput.RepetInterval,
+		FirstDate:              userInput.FirstDate,
+		LastDate:               userInput.LastDate,
+		ReturnDate:             userInput.ReturnDate,
+		ReturnRoute:            userInput.ReturnRoute,
+		Routes:                 userInput.Routes,
+		StateFile:              userInput.StateFile,
+		Proxy:                  userInput.Proxy,
+		DisableHTTP2:           userInput.DisableHTTP2,
+		DisableKeepAlive:       userInput.DisableKeepAlive,
+		APIURL:                 userInput.APIURL,
+		APIAuthorization:       userInput.APIAuthorization,
+		NotifyErrors:           userInput.NotifyErrors,
+		Once:                   userInput.Once,
+		ExitOnFirstMatch:       userInput.ExitOnFirstMatch,
+		WarmupNoNotify:         userInput.WarmupNoNotify,
+		FailFast:               userInput.FailFast,
+		OutputJSON:             userInput.OutputJSON,
+		MaxRetries:             userInput.MaxRetries,
+		BackoffAfter:           userInput.BackoffAfter,
+		MaxBackoffInterval:     userInput.MaxBackoffInterval,
+		BreakerThreshold:       userInput.BreakerThreshold,
+		BreakerWindow:          userInput.BreakerWindow,
+		BreakerCooldown:        userInput.BreakerCooldown,
+		Concurrency:            userInput.Concurrency,
+		Adults:                 userInput.Adults,
+		Children:               userInput.Children,
+		Infants:                userInput.Infants,
+		InfantsWithSeat:        userInput.InfantsWithSeat,
+		MaxPrice:               userInput.MaxPrice,
+		MinSeats:               userInput.MinSeats,
+		MinAdvanceDays:         userInput.MinAdvanceDays,
+		MaxAdvanceDays:         userInput.MaxAdvanceDays,
+		Currency:               userInput.Currency,
+		Locale:                 userInput.Locale,
+		CabinClass:             userInput.CabinClass,
+		AllFares:               userInput.AllFares,
+		IncludeSoldOut:         userInput.IncludeSoldOut,
+		RepetInterval:          userInput.RepetInterval,
+		RouteIntervals:         userInput.RouteIntervals,
+		Jitter:                 userInput.Jitter,
+		RequestTimeout:         userInput.RequestTimeout,
+		QuietHours:             userInput.QuietHours,
+		NotifyCooldown:         userInput.NotifyCooldown,
+		SummaryInterval:        userInput.SummaryInterval,
+		LatencyStatsInterval:   userInput.LatencyStatsInterval,
+		MaxNotificationsPerDay: userInput.MaxNotificationsPerDay,
+		Deadline:               userInput.Deadline,
+	}
+	if len(userInput.Dates) > 0 {
+		botConfig.days = userInput.Dates
+	} else {
+		for current := userInput.FirstDate; !current.After(userInput.LastDate); current = current.AddDate(0, 0, 1) {
+			botConfig.days = append(botConfig.days, current.Format("2006-01-02"))
+		}
+	}
+	if userInput.PrintDeeplink {
+		for _, queryConf := range botConfig.queryConfigs() {
+			for _, day := range botConfig.days {
+				queryConf.DepartureDate = day
+				link, err := bookingURL(&queryConf)
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+				fmt.Printf("%s-%s %s: %s\n", queryConf.From, queryConf.To, day, link)
+			}
+		}
+		os.Exit(0)
+	}
+	if userInput.Check {
+		fmt.Print("Configuration OK\n\n")
+		fmt.Println(strings.TrimPrefix(botConfig.startMessage(), InstanceName+" started\n\n"))
+		fmt.Printf("Days: %d\n", len(botConfig.days))
+		fmt.Printf("Notifications: %s\n", strings.Join(userInput.notificationBackends(), ", "))
+		if userInput.PrimaryBackend != "" {
+			fmt.Printf("Fallback: %s, when %s fails\n", userInput.FallbackBackend, userInput.PrimaryBackend)
+		}
+		os.Exit(0)
+	}
+	if userInput.DumpResponsesDir != "" {
+		if err := os.MkdirAll(userInput.DumpResponsesDir, 0o755); err != nil {
+			fmt.Printf("Error: dump responses: %v\n", err)
+			os.Exit(1)
+		}
+		DumpResponsesDir = userInput.DumpResponsesDir
+	}
+	Trace = userInput.Trace
+	if userInput.RateLimit > 0 {
+		requestLimiter = newTokenBucket(userInput.RateLimit)
+	}
+	if userInput.MaxRequests > 0 {
+		requestBudget = &RequestBudget{Max: int64(userInput.MaxRequests)}
 	}
-	for current := userInput.FirstDate; !current.After(userInput.LastDate); current = current.AddDate(0, 0, 1) {
-		botConfig.days = append(botConfig.days, current.Format("2006-01-02"))
+	if userInput.RandomUserAgent {
+		userAgentRotator = newUserAgentRotator(userInput.Seed)
+		logger.Info(LogFields{Event: "user_agent_rotation"}, fmt.Sprintf("Rotating the User-Agent with seed %d", userInput.Seed))
 	}
+	if userInput.DisplayCurrency != "" {
+		// The rate is fetched once and used for the whole run; without it the fares are shown as they are.
+		rate, err := fetchExchangeRate(&http.Client{Timeout: 10 * time.Second}, userInput.FXURL, userInput.Currency, userInput.DisplayCurrency)
+		if err != nil {
+			logger.Warn(LogFields{Event: "exchange_rate_failed"}, "Warning: could not get the exchange rate, fares are shown in ", userInput.Currency, " only: ", err.Error())
+		} else {
+			displayRate = rate
+			logger.Info(LogFields{Event: "exchange_rate"}, fmt.Sprintf("1 %s = %g %s", rate.From, rate.Rate, rate.To))
+		}
+	}
+	// signalCtx is cancelled on SIGINT or SIGTERM, which stops the bot and its in-flight requests.
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	ifAvailableFunc := func(avialableFlights AvialableFlights) error { return nil }
-	ifErrorFunc := func(err error) error { return nil }
+	var (
+		flightNotifiers  []func(avialableFlights AvialableFlights) error
+		removalNotifiers []func(removedFlights AvialableFlights) error
+		errorNotifiers   []func(err error) error
+		// flightNotifierNames names the flightNotifiers for the test-notify command,
+		// and backendErrors holds the startup checks that failed, by name.
+		flightNotifierNames []string
+		backendErrors       = make(map[string]error)
+	)
 	if userInput.TelegramBotKey != "" {
 		telegramRequest := &TelegramRequest{
+			Context: signalCtx,
+			Client:  &http.Client{},
+			APIURL:  userInput.TelegramAPIURL,
+			BotKey:  userInput.TelegramBotKey,
+			ChatIDs: userInput.TelegramChatIDs,
+			DryRun:  userInput.DryRun,
+		}
+		if err := telegramRequest.validate(); err != nil {
+			// The test-notify command reports a failing backend instead of exiting.
+			if !userInput.TestNotifyCommand {
+				fmt.Printf("Error: telegram: %v\n", err)
+				os.Exit(1)
+			}
+			backendErrors["telegram"] = err
+		}
+		switch {
+		case userInput.NoStartNotification || userInput.TestNotifyCommand:
+		case userInput.DailyStartNotification && startNotifiedToday(userInput.StateFile):
+			logger.Debug(LogFields{Event: "start_notification_skipped"}, "The start notification was already sent today")
+		default:
+			if err := telegramRequest.sendTelegramStartNotification(botConfig); err != nil {
+				logger.Error(LogFields{Event: "notification_failed"}, err.Error())
+			} else if userInput.DailyStartNotification && !userInput.DryRun {
+				if err := markStartNotified(userInput.StateFile); err != nil {
+					logger.Error(LogFields{Event: "state_save_failed"}, "Error: saving state file: ", err.Error())
+				}
+			}
+		}
+		flightNotifiers = append(flightNotifiers, telegramRequest.sendTelegramFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "telegram")
+		removalNotifiers = append(removalNotifiers, telegramRequest.sendTelegramRemovalNotification)
+		errorNotifiers = append(errorNotifiers, telegramRequest.sendTelegramErrorNotification)
+	}
+	if userInput.DiscordWebhook != "" {
+		discordRequest := &DiscordRequest{
+			Client:     &http.Client{},
+			WebhookURL: userInput.DiscordWebhook,
+			DryRun:     userInput.DryRun,
+		}
+		flightNotifiers = append(flightNotifiers, discordRequest.sendDiscordFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "discord")
+		removalNotifiers = append(removalNotifiers, discordRequest.sendDiscordRemovalNotification)
+	}
+	if userInput.SlackWebhook != "" {
+		slackRequest := &SlackRequest{
+			Client:     &http.Client{},
+			WebhookURL: userInput.SlackWebhook,
+			DryRun:     userInput.DryRun,
+		}
+		flightNotifiers = append(flightNotifiers, slackRequest.sendSlackFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "slack")
+		removalNotifiers = append(removalNotifiers, slackRequest.sendSlackRemovalNotification)
+	}
+	if userInput.PushoverToken != "" {
+		pushoverRequest := &PushoverRequest{
 			Client: &http.Client{},
-			BotKey: userInput.TelegramBotKey,
-			ChatID: userInput.TelegramChatID,
+			Token:  userInput.PushoverToken,
+			User:   userInput.PushoverUser,
+			DryRun: userInput.DryRun,
+		}
+		flightNotifiers = append(flightNotifiers, pushoverRequest.sendPushoverFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "pushover")
+		removalNotifiers = append(removalNotifiers, pushoverRequest.sendPushoverRemovalNotification)
+	}
+	if userInput.NtfyURL != "" {
+		ntfyRequest := &NtfyRequest{
+			Client: &http.Client{},
+			URL:    userInput.NtfyURL,
+			Token:  userInput.NtfyToken,
+			DryRun: userInput.DryRun,
+		}
+		flightNotifiers = append(flightNotifiers, ntfyRequest.sendNtfyFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "ntfy")
+		removalNotifiers = append(removalNotifiers, ntfyRequest.sendNtfyRemovalNotification)
+	}
+	if userInput.MatrixHomeserver != "" {
+		matrixRequest := &MatrixRequest{
+			Client:     &http.Client{Timeout: 30 * time.Second},
+			Homeserver: userInput.MatrixHomeserver,
+			Token:      userInput.MatrixToken,
+			Room:       userInput.MatrixRoom,
+			DryRun:     userInput.DryRun,
+		}
+		if err := matrixRequest.validate(); err != nil {
+			if !userInput.TestNotifyCommand {
+				fmt.Printf("Error: matrix: %v\n", err)
+				os.Exit(1)
+			}
+			backendErrors["matrix"] = err
 		}
-		if err := telegramRequest.sendTelegramStartNotification(botConfig); err != nil {
-			log.Println(Colored(Colors.Red, err.Error()))
+		flightNotifiers = append(flightNotifiers, matrixRequest.sendMatrixFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "matrix")
+		removalNotifiers = append(removalNotifiers, matrixRequest.sendMatrixRemovalNotification)
+	}
+	if userInput.SMTPHost != "" {
+		emailRequest := &EmailRequest{
+			Host:   userInput.SMTPHost,
+			Port:   userInput.SMTPPort,
+			User:   userInput.SMTPUser,
+			Pass:   userInput.SMTPPass,
+			From:   userInput.EmailFrom,
+			To:     userInput.EmailTo,
+			DryRun: userInput.DryRun,
+		}
+		flightNotifiers = append(flightNotifiers, emailRequest.sendEmailFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "email")
+		removalNotifiers = append(removalNotifiers, emailRequest.sendEmailRemovalNotification)
+	}
+	if userInput.TwilioSID != "" {
+		twilioRequest := &TwilioRequest{
+			Client: &http.Client{Timeout: 30 * time.Second},
+			SID:    userInput.TwilioSID,
+			Token:  userInput.TwilioToken,
+			From:   userInput.TwilioFrom,
+			To:     userInput.SMSTo,
+			DryRun: userInput.DryRun,
+		}
+		flightNotifiers = append(flightNotifiers, twilioRequest.sendTwilioFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "sms")
+		removalNotifiers = append(removalNotifiers, twilioRequest.sendTwilioRemovalNotification)
+	}
+	if userInput.WebhookURL != "" {
+		webhookRequest := &WebhookRequest{
+			Client: &http.Client{Timeout: userInput.WebhookTimeout},
+			URL:    userInput.WebhookURL,
+			DryRun: userInput.DryRun,
+		}
+		flightNotifiers = append(flightNotifiers, webhookRequest.sendWebhookFlightNotification)
+		flightNotifierNames = append(flightNotifierNames, "webhook")
+		removalNotifiers = append(removalNotifiers, webhookRequest.sendWebhookRemovalNotification)
+	}
+	if userInput.DryRun && len(flightNotifiers) == 0 {
+		// Without any backend configured, show the messages Telegram would get.
+		printDryRun("stdout", botConfig.startMessage())
+		flightNotifiers = append(flightNotifiers, func(avialableFlights AvialableFlights) error {
+			printDryRun("stdout", avialableFlights.message())
+			return nil
+		})
+		flightNotifierNames = append(flightNotifierNames, "stdout")
+		removalNotifiers = append(removalNotifiers, func(removedFlights AvialableFlights) error {
+			printDryRun("stdout", removedFlights.removedMessage())
+			return nil
+		})
+	}
+
+	// Routes listed in route-notifications go to their own targets instead of the backends above.
+	var (
+		overriddenRoutes      = make(map[string]bool)
+		routeFlightNotifiers  = make(map[string][]func(avialableFlights AvialableFlights) error)
+		routeRemovalNotifiers = make(map[string][]func(removedFlights AvialableFlights) error)
+		routeNotifierNames    = make(map[string][]string)
+	)
+	for _, routeNotification := range userInput.RouteNotifications {
+		route := routeNotification.Route
+		overriddenRoutes[route] = true
+		if len(routeNotification.TelegramChatID) > 0 {
+			telegramRequest := &TelegramRequest{
+				Context: signalCtx,
+				Client:  &http.Client{},
+				APIURL:  userInput.TelegramAPIURL,
+				BotKey:  userInput.TelegramBotKey,
+				ChatIDs: routeNotification.TelegramChatID,
+				DryRun:  userInput.DryRun,
+			}
+			if err := telegramRequest.validate(); err != nil {
+				if !userInput.TestNotifyCommand {
+					fmt.Printf("Error: route-notifications: %s: telegram: %v\n", route, err)
+					os.Exit(1)
+				}
+				backendErrors[fmt.Sprintf("telegram (%s)", route)] = err
+			}
+			routeFlightNotifiers[route] = append(routeFlightNotifiers[route], telegramRequest.sendTelegramFlightNotification)
+			routeNotifierNames[route] = append(routeNotifierNames[route], "telegram")
+			routeRemovalNotifiers[route] = append(routeRemovalNotifiers[route], telegramRequest.sendTelegramRemovalNotification)
+		}
+		if routeNotification.DiscordWebhook != "" {
+			discordRequest := &DiscordRequest{
+				Client:     &http.Client{},
+				WebhookURL: routeNotification.DiscordWebhook,
+				DryRun:     userInput.DryRun,
+			}
+			routeFlightNotifiers[route] = append(routeFlightNotifiers[route], discordRequest.sendDiscordFlightNotification)
+			routeNotifierNames[route] = append(routeNotifierNames[route], "discord")
+			routeRemovalNotifiers[route] = append(routeRemovalNotifiers[route], discordRequest.sendDiscordRemovalNotification)
+		}
+		if routeNotification.SlackWebhook != "" {
+			slackRequest := &SlackRequest{
+				Client:     &http.Client{},
+				WebhookURL: routeNotification.SlackWebhook,
+				DryRun:     userInput.DryRun,
+			}
+			routeFlightNotifiers[route] = append(routeFlightNotifiers[route], slackRequest.sendSlackFlightNotification)
+			routeNotifierNames[route] = append(routeNotifierNames[route], "slack")
+			routeRemovalNotifiers[route] = append(routeRemovalNotifiers[route], slackRequest.sendSlackRemovalNotification)
+		}
+		if routeNotification.WebhookURL != "" {
+			webhookRequest := &WebhookRequest{
+				Client: &http.Client{Timeout: userInput.WebhookTimeout},
+				URL:    routeNotification.WebhookURL,
+				DryRun: userInput.DryRun,
+			}
+			routeFlightNotifiers[route] = append(routeFlightNotifiers[route], webhookRequest.sendWebhookFlightNotification)
+			routeNotifierNames[route] = append(routeNotifierNames[route], "webhook")
+			routeRemovalNotifiers[route] = append(routeRemovalNotifiers[route], webhookRequest.sendWebhookRemovalNotification)
 		}
-		ifAvailableFunc = func(avialableFlights AvialableFlights) error {
-			if len(avialableFlights) > 0 {
-				return telegramRequest.sendTelegramFlightNotification(avialableFlights)
+	}
+
+	if userInput.TestNotifyCommand {
+		names, notifiers := flightNotifierNames, flightNotifiers
+		for _, routeNotification := range userInput.RouteNotifications {
+			for _, name := range routeNotifierNames[routeNotification.Route] {
+				names = append(names, fmt.Sprintf("%s (%s)", name, routeNotification.Route))
 			}
+			notifiers = append(notifiers, routeFlightNotifiers[routeNotification.Route]...)
+		}
+		if len(notifiers) == 0 {
+			fmt.Println("Error: no notification backend is configured")
+			os.Exit(1)
+		}
+		if !testBackends(botConfig, names, notifiers, backendErrors) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if userInput.PrimaryBackend != "" {
+		primary := slices.Index(flightNotifierNames, userInput.PrimaryBackend)
+		fallback := slices.Index(flightNotifierNames, userInput.FallbackBackend)
+		if primary < 0 {
+			fmt.Printf("Error: primary backend %s is not configured\n", userInput.PrimaryBackend)
+			os.Exit(1)
+		}
+		if fallback < 0 {
+			fmt.Printf("Error: fallback backend %s is not configured\n", userInput.FallbackBackend)
+			os.Exit(1)
+		}
+		// The fallback isn't notified on its own; the primary's notifiers fall back to it.
+		flightNotifiers[primary] = withFallback(userInput.PrimaryBackend, userInput.FallbackBackend, flightNotifiers[primary], flightNotifiers[fallback])
+		removalNotifiers[primary] = withFallback(userInput.PrimaryBackend, userInput.FallbackBackend, removalNotifiers[primary], removalNotifiers[fallback])
+		flightNotifiers = slices.Delete(flightNotifiers, fallback, fallback+1)
+		removalNotifiers = slices.Delete(removalNotifiers, fallback, fallback+1)
+		flightNotifierNames = slices.Delete(flightNotifierNames, fallback, fallback+1)
+	}
+
+	ifAvailableFunc := func(avialableFlights AvialableFlights) error {
+		if len(avialableFlights) == 0 {
 			return nil
 		}
-		ifErrorFunc = func(err error) error {
-			if err != nil {
-				return telegramRequest.sendTelegramErrorNotification(err)
+		var errs []error
+		if userInput.CSVFile != "" {
+			if err := appendCSV(userInput.CSVFile, avialableFlights); err != nil {
+				errs = append(errs, fmt.Errorf("csv file: %w", err))
+			}
+		}
+		rest, routed := avialableFlights.splitRoutes(overriddenRoutes)
+		notify := func(flights AvialableFlights, notifiers []func(avialableFlights AvialableFlights) error) {
+			if len(flights) == 0 {
+				return
+			}
+			for _, notify := range notifiers {
+				if err := notify(flights); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				metrics.NotificationsSent.Inc()
+			}
+		}
+		notify(rest, flightNotifiers)
+		for route, flights := range routed {
+			notify(flights, routeFlightNotifiers[route])
+		}
+		return errors.Join(errs...)
+	}
+	if userInput.TestNotify {
+		if len(flightNotifiers) == 0 {
+			logger.Warn(LogFields{Event: "test_notification_skipped"}, "No notification backend is configured, skipping the test notification")
+		} else if err := sendTestNotification(botConfig, flightNotifiers); err != nil {
+			logger.Error(LogFields{Event: "test_notification_failed"}, "Error: test notification: ", err.Error())
+		} else {
+			logger.Info(LogFields{Event: "test_notification_sent"}, "Test notification sent")
+		}
+	}
+
+	var ifRemovedFunc func(removedFlights AvialableFlights) error
+	if userInput.NotifyRemovals {
+		ifRemovedFunc = func(removedFlights AvialableFlights) error {
+			var errs []error
+			rest, routed := removedFlights.splitRoutes(overriddenRoutes)
+			notify := func(flights AvialableFlights, notifiers []func(removedFlights AvialableFlights) error) {
+				if len(flights) == 0 {
+					return
+				}
+				for _, notify := range notifiers {
+					if err := notify(flights); err != nil {
+						errs = append(errs, err)
+						continue
+					}
+					metrics.NotificationsSent.Inc()
+				}
+			}
+			notify(rest, removalNotifiers)
+			for route, flights := range routed {
+				notify(flights, routeRemovalNotifiers[route])
 			}
+			return errors.Join(errs...)
+		}
+	}
+	ifErrorFunc := func(err error) error {
+		if err == nil {
 			return nil
 		}
+		if userInput.QuietHours.contains(time.Now()) {
+			logger.Debug(LogFields{Event: "quiet_hours"}, "Quiet hours, dropping the error notification: ", err.Error())
+			return nil
+		}
+		var errs []error
+		for _, notify := range errorNotifiers {
+			if err := notify(err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
 	}
 
-	startBot(
+	// Shutdown hooks run when the bot receives SIGINT or SIGTERM.
+	var shutdownHooks []func()
+	serve := func(name, addr, pattern string, handler http.Handler) {
+		mux := http.NewServeMux()
+		mux.Handle(pattern, handler)
+		server := startServer(name, addr, mux)
+		shutdownHooks = append(shutdownHooks, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		})
+	}
+	if userInput.MetricsAddr != "" {
+		serve("metrics", userInput.MetricsAddr, "/metrics", promhttp.Handler())
+	}
+	if userInput.HealthAddr != "" {
+		serve("health", userInput.HealthAddr, "/healthz", health)
+	}
+	if logFile != nil {
+		// Last, so the other hooks can still log.
+		shutdownHooks = append(shutdownHooks, func() { logFile.Close() })
+	}
+	go func() {
+		<-signalCtx.Done()
+		// A second signal kills the bot right away.
+		stop()
+		logger.Info(LogFields{Event: "shutdown"}, "Stopping")
+		// Normally startBot returns first; this only forces the exit if a notification hangs.
+		time.Sleep(ShutdownTimeout)
+		for _, hook := range shutdownHooks {
+			hook()
+		}
+		os.Exit(0)
+	}()
+
+	exitCode := startBot(
+		signalCtx,
 		botConfig,
 		ifAvailableFunc,
+		ifRemovedFunc,
 		ifErrorFunc,
 	)
+	for _, hook := range shutdownHooks {
+		hook()
+	}
+	if signalCtx.Err() != nil {
+		os.Exit(0)
+	}
+	os.Exit(exitCode)
 }
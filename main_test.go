@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aykhans/azal-bot/azal"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// searchResponse is a successful search response with a flight departing at 08:30 on day.
+func searchResponse(day string) string {
+	return fmt.Sprintf(`{"search":{"optionSets":[{"options":[`+
+		`{"id":"o1","available":true,"cheapestEconomySolutionId":"s1","route":{"id":"r1","departureDate":"%sT08:30:00"}}`+
+		`]}],"solutions":[{"id":"s1","price":{"amount":149,"currency":"AZN"}}]}}`, day)
+}
+
+// testBotConfig searches NAJ-GYD once on each of days against apiURL.
+func testBotConfig(apiURL string, days ...string) *BotConfig {
+	firstDate, _ := time.ParseInLocation("2006-01-02", days[0], azal.Timezone)
+	lastDate, _ := time.ParseInLocation("2006-01-02", days[len(days)-1], azal.Timezone)
+	return &BotConfig{
+		FirstDate:      firstDate,
+		LastDate:       lastDate.Add(24*time.Hour - time.Second),
+		Routes:         []Route{{From: "NAJ", To: "GYD"}},
+		days:           days,
+		APIURL:         apiURL,
+		Once:           true,
+		Concurrency:    1,
+		RepetInterval:  time.Minute,
+		RequestTimeout: 30 * time.Second,
+	}
+}
+
+func TestStartBotRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		day := r.URL.Query().Get("departure_date")
+		if day == "2030-01-01" {
+			// Hang until the client gives up.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		fmt.Fprint(w, searchResponse(day))
+	}))
+	defer server.Close()
+
+	botConfig := testBotConfig(server.URL, "2030-01-01", "2030-01-02")
+	botConfig.RequestTimeout = 100 * time.Millisecond
+	var found AvialableFlights
+	start := time.Now()
+	exitCode := startBot(
+		context.Background(), botConfig,
+		func(avialableFlights AvialableFlights) error { found = avialableFlights; return nil },
+		nil,
+		func(err error) error { return nil },
+	)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("startBot took %s, the slow request wasn't aborted", elapsed)
+	}
+	if exitCode != ExitCodeFlightsFound {
+		t.Errorf("exit code = %d, want %d", exitCode, ExitCodeFlightsFound)
+	}
+	if len(found["NAJ-GYD 2030-01-02"]) != 1 {
+		t.Errorf("flights of the day after the slow one = %v, want one flight", found)
+	}
+	if _, ok := found["NAJ-GYD 2030-01-01"]; ok {
+		t.Errorf("flights found for the day that timed out: %v", found)
+	}
+}
+
+func TestSendRequestWithRetry(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, searchResponse("2030-01-01"))
+	}))
+	defer server.Close()
+
+	queryConf := &azal.QueryConfig{From: "NAJ", To: "GYD", DepartureDate: "2030-01-01"}
+	data, err := sendRequestWithRetry(context.Background(), server.Client(), server.URL, queryConf, &azal.HeaderConfig{}, 3)
+	if err != nil {
+		t.Fatalf("sendRequestWithRetry: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+	if len(data.Search.OptionSets) != 1 || len(data.Search.OptionSets[0].Options) != 1 {
+		t.Errorf("options = %+v, want the one of the last response", data.Search.OptionSets)
+	}
+}
+
+func TestSendRequestCancel(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	queryConf := &azal.QueryConfig{From: "NAJ", To: "GYD", DepartureDate: "2030-01-01"}
+	start := time.Now()
+	_, err := sendRequest(ctx, server.Client(), server.URL, queryConf, &azal.HeaderConfig{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sendRequest returned after %s, the cancellation didn't abort it", elapsed)
+	}
+}
+
+func TestSendTelegramMessageRetryAfter(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"ok":false,"error_code":429,"parameters":{"retry_after":1}}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok":true}`)
+	}))
+	defer server.Close()
+
+	telegramRequest := &TelegramRequest{Client: server.Client(), APIURL: server.URL, BotKey: "key"}
+	start := time.Now()
+	if err := telegramRequest.sendTelegramMessageToChat("1", "test", ""); err != nil {
+		t.Fatalf("sendTelegramMessageToChat: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2 (one retry)", requests)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want at least the retry_after of 1s", elapsed)
+	}
+}
+
+func TestUniqueOptions(t *testing.T) {
+	var options []azal.ResponseOption
+	err := json.Unmarshal([]byte(`[
+		{"id":"o1","route":{"id":"r1","departureDate":"2030-01-01T08:30:00"}},
+		{"id":"o2","route":{"id":"r2","departureDate":"2030-01-01T12:00:00"}},
+		{"id":"o1","route":{"id":"r1","departureDate":"2030-01-01T08:30:00"}},
+		{"id":"o3","route":{"id":"r3","departureDate":"2030-01-01T18:45:00"}}
+	]`), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unique, duplicates := uniqueOptions(options)
+	if duplicates != 1 {
+		t.Errorf("duplicates = %d, want 1", duplicates)
+	}
+	var ids []string
+	for _, option := range unique {
+		ids = append(ids, option.ID)
+	}
+	if fmt.Sprint(ids) != "[o1 o2 o3]" {
+		t.Errorf("options = %v, want [o1 o2 o3]", ids)
+	}
+}
+
+func TestNewAvialableFlightAcrossTimezones(t *testing.T) {
+	var option azal.ResponseOption
+	err := json.Unmarshal([]byte(`{"id":"o1","route":{"id":"r1",`+
+		`"departureDate":"2030-01-01T08:00:00","arrivalDate":"2030-01-01T09:00:00"}}`), &option)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		route Route
+		want  time.Duration
+	}{
+		{Route{From: "GYD", To: "NAJ"}, time.Hour},
+		// Istanbul is an hour behind Baku.
+		{Route{From: "GYD", To: "IST"}, 2 * time.Hour},
+		{Route{From: "IST", To: "GYD"}, 0},
+		// Unknown airports are read in Baku time.
+		{Route{From: "GYD", To: "XYZ"}, time.Hour},
+	}
+	for _, test := range tests {
+		flight := newAvialableFlight(&azal.SuccessResponse{}, test.route, option)
+		if got := flight.ArrivalDate.Sub(flight.DepartureDate); got != test.want {
+			t.Errorf("%s duration = %s, want %s", test.route, got, test.want)
+		}
+	}
+}
+
+func TestSummaryDateFormat(t *testing.T) {
+	defer func(dateFormat, timeFormat string) { DateFormat, TimeFormat = dateFormat, timeFormat }(DateFormat, TimeFormat)
+	DateFormat, TimeFormat = "02.01.2006", "3:04:05 PM"
+
+	avialableFlights := AvialableFlights{
+		"GYD-NAJ 2030-01-02": {{DepartureDate: time.Date(2030, 1, 2, 14, 30, 0, 0, Timezone), EconomyPrice: &azal.Price{Amount: 149, Currency: "AZN"}}},
+	}
+	want := "Flights\nGYD-NAJ 02.01.2030 2:30 PM 149 AZN"
+	if got := avialableFlights.summary("Flights", SMSMaxFlights); got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+}
+
+func TestDiffFlights(t *testing.T) {
+	const key = "NAJ-GYD 2030-01-01"
+	morning := time.Date(2030, 1, 1, 8, 30, 0, 0, Timezone)
+	a := AvialableFlight{ID: "r1", DepartureDate: morning}
+	b := AvialableFlight{ID: "r2", DepartureDate: morning.Add(4 * time.Hour)}
+	rescheduled := AvialableFlight{ID: "r1", DepartureDate: morning.Add(30 * time.Minute)}
+	otherID := AvialableFlight{ID: "r3", DepartureDate: morning}
+	withoutID := AvialableFlight{DepartureDate: morning}
+	soldOut := AvialableFlight{ID: "r1", DepartureDate: morning, SoldOut: true}
+
+	tests := []struct {
+		name                   string
+		previous, current      AvialableFlights
+		wantAdded, wantRemoved AvialableFlights
+	}{
+		{"first check", nil, AvialableFlights{key: {a, b}}, AvialableFlights{key: {a, b}}, AvialableFlights{}},
+		{"unchanged", AvialableFlights{key: {a, b}}, AvialableFlights{key: {a, b}}, AvialableFlights{}, AvialableFlights{}},
+		{"added", AvialableFlights{key: {a}}, AvialableFlights{key: {a, b}}, AvialableFlights{key: {b}}, AvialableFlights{}},
+		{"removed", AvialableFlights{key: {a, b}}, AvialableFlights{key: {a}}, AvialableFlights{}, AvialableFlights{key: {b}}},
+		{"day removed", AvialableFlights{key: {a}}, AvialableFlights{}, AvialableFlights{}, AvialableFlights{key: {a}}},
+		{"same ID, other time", AvialableFlights{key: {a}}, AvialableFlights{key: {rescheduled}}, AvialableFlights{}, AvialableFlights{}},
+		{"other ID, same time", AvialableFlights{key: {a}}, AvialableFlights{key: {otherID}}, AvialableFlights{key: {otherID}}, AvialableFlights{key: {a}}},
+		{"no ID, same time", AvialableFlights{key: {withoutID}}, AvialableFlights{key: {a}}, AvialableFlights{}, AvialableFlights{}},
+		{"sold out to bookable", AvialableFlights{key: {soldOut}}, AvialableFlights{key: {a}}, AvialableFlights{key: {a}}, AvialableFlights{key: {soldOut}}},
+		{"bookable to sold out", AvialableFlights{key: {a}}, AvialableFlights{key: {soldOut}}, AvialableFlights{key: {soldOut}}, AvialableFlights{key: {a}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			added, removed := DiffFlights(test.previous, test.current)
+			if !reflect.DeepEqual(added, test.wantAdded) {
+				t.Errorf("added = %v, want %v", added, test.wantAdded)
+			}
+			if !reflect.DeepEqual(removed, test.wantRemoved) {
+				t.Errorf("removed = %v, want %v", removed, test.wantRemoved)
+			}
+		})
+	}
+}
+
+// benchmarkSendRequest sends the same search b.N times, through one client when
+// reuse is set, like startBot, or through a new client per request otherwise.
+func benchmarkSendRequest(b *testing.B, reuse bool) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, searchResponse("2030-01-01"))
+	}))
+	defer server.Close()
+
+	queryConf := &azal.QueryConfig{From: "NAJ", To: "GYD", DepartureDate: "2030-01-01"}
+	headerConf := &azal.HeaderConfig{}
+	client := &http.Client{Transport: newTransport(nil, false, false)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if !reuse {
+			client.CloseIdleConnections()
+			client = &http.Client{Transport: newTransport(nil, false, false)}
+		}
+		if _, err := sendRequest(context.Background(), client, server.URL, queryConf, headerConf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	client.CloseIdleConnections()
+}
+
+func BenchmarkSendRequest(b *testing.B) {
+	benchmarkSendRequest(b, true)
+}
+
+// BenchmarkSendRequestNewClient is the client per request sendRequest used to
+// create, for comparison with BenchmarkSendRequest.
+func BenchmarkSendRequestNewClient(b *testing.B) {
+	benchmarkSendRequest(b, false)
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	tokenBucket := newTokenBucket(5)
+	tokenBucket.Burst, tokenBucket.tokens = 1, 1
+	if err := tokenBucket.wait(context.Background()); err != nil {
+		t.Fatalf("first wait: %v", err)
+	}
+	start := time.Now()
+	if err := tokenBucket.wait(context.Background()); err != nil {
+		t.Fatalf("second wait: %v", err)
+	}
+	// The second token is available 1/5s after the first.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("second wait took %s, want about 200ms", elapsed)
+	}
+
+	tokenBucket = newTokenBucket(0.1)
+	tokenBucket.wait(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	if err := tokenBucket.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled wait returned after %s, want promptly", elapsed)
+	}
+	// The first wait took the only token, the cancelled one gave its reservation back.
+	if tokenBucket.tokens < -0.5 || tokenBucket.tokens > 0.5 {
+		t.Errorf("tokens = %f, want 0 with the cancelled token given back", tokenBucket.tokens)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var changes []bool
+	circuitBreaker := &CircuitBreaker{
+		Threshold: 2,
+		Window:    time.Minute,
+		Cooldown:  50 * time.Millisecond,
+		OnChange:  func(open bool, reason string) { changes = append(changes, open) },
+	}
+	step := func(name string, wantAllow bool) {
+		t.Helper()
+		if got := circuitBreaker.allow(); got != wantAllow {
+			t.Fatalf("%s: allow = %t, want %t", name, got, wantAllow)
+		}
+	}
+
+	step("closed", true)
+	circuitBreaker.record(true)
+	step("one failure", true)
+	circuitBreaker.record(true)
+	step("open", false)
+	if fmt.Sprint(changes) != "[true]" {
+		t.Fatalf("changes after the threshold = %v, want [true]", changes)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	step("half-open", true)
+	step("half-open, probe in flight", false)
+	circuitBreaker.record(true)
+	step("probe failed", false)
+
+	time.Sleep(60 * time.Millisecond)
+	step("half-open again", true)
+	circuitBreaker.record(false)
+	step("closed again", true)
+	if fmt.Sprint(changes) != "[true false]" {
+		t.Errorf("changes = %v, want [true false]", changes)
+	}
+
+	// The failures before the circuit closed don't count towards the next opening.
+	circuitBreaker.record(true)
+	step("one new failure", true)
+}
+
+func TestQuietHoursContains(t *testing.T) {
+	tests := []struct {
+		window string
+		at     string
+		want   bool
+	}{
+		{"22:00-07:00", "23:00", true},
+		{"22:00-07:00", "03:00", true},
+		{"22:00-07:00", "07:00", false},
+		{"22:00-07:00", "12:00", false},
+		{"22:00-07:00", "22:00", true},
+		{"12:00-14:00", "13:00", true},
+		{"12:00-14:00", "14:00", false},
+		{"12:00-14:00", "23:00", false},
+		{"12:00-14:00", "11:59", false},
+	}
+	for _, test := range tests {
+		quietHours, err := parseQuietHours(test.window)
+		if err != nil {
+			t.Fatalf("parseQuietHours(%q): %v", test.window, err)
+		}
+		at, _ := time.ParseInLocation("15:04", test.at, Timezone)
+		at = time.Date(2030, 1, 1, at.Hour(), at.Minute(), 0, 0, Timezone)
+		if got := quietHours.contains(at); got != test.want {
+			t.Errorf("%s contains %s = %t, want %t", test.window, test.at, got, test.want)
+		}
+	}
+
+	if (*QuietHours)(nil).contains(time.Now()) {
+		t.Error("nil QuietHours contains a time")
+	}
+	for _, window := range []string{"22:00", "22:00-07:00-08:00", "25:00-07:00", "07:00-07:00"} {
+		if _, err := parseQuietHours(window); err == nil {
+			t.Errorf("parseQuietHours(%q) succeeded, want an error", window)
+		}
+	}
+}
+
+func TestParseRelativeDate(t *testing.T) {
+	defer func(timezone *time.Location) { Timezone = timezone }(Timezone)
+	Timezone, _ = time.LoadLocation("America/New_York")
+	// It is already 2030-01-01 in UTC, but still 2029-12-31 in New York.
+	now := time.Date(2030, 1, 1, 2, 0, 0, 0, time.UTC)
+	today := time.Date(2029, 12, 31, 0, 0, 0, 0, Timezone)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"today", today},
+		{"+0d", today},
+		{"+7d", today.AddDate(0, 0, 7)},
+		{"today+7d", today.AddDate(0, 0, 7)},
+		{"+2w", today.AddDate(0, 0, 14)},
+		{"+1w", today.AddDate(0, 0, 7)},
+	}
+	for _, test := range tests {
+		got, err := parseRelativeDate(test.value, now)
+		if err != nil {
+			t.Errorf("parseRelativeDate(%q): %v", test.value, err)
+			continue
+		}
+		if !got.Equal(test.want) || got.Location() != Timezone {
+			t.Errorf("parseRelativeDate(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+
+	for _, value := range []string{"+7", "+d", "7d", "+7m", "+-1d", "today-1d", "todayx", "+70000d", "+1.5w"} {
+		if got, err := parseRelativeDate(value, now); err == nil {
+			t.Errorf("parseRelativeDate(%q) = %s, want an error", value, got)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.log")
+	rotatingFile, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := noColorWriter{rotatingFile}
+	// Each line is 40 bytes once the colors are stripped, so a file holds two.
+	for i := range 10 {
+		line := fmt.Sprintf("\x1b[31mline %02d%s\x1b[0m\n", i, strings.Repeat(".", 32))
+		if n, err := w.Write([]byte(line)); err != nil || n != len(line) {
+			t.Fatalf("Write = %d, %v, want %d", n, err, len(line))
+		}
+	}
+	if err := rotatingFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for suffix, want := range map[string][]string{"": {"line 08", "line 09"}, ".1": {"line 06", "line 07"}, ".2": {"line 04", "line 05"}} {
+		content, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(content), "\x1b") {
+			t.Errorf("bot.log%s has escape codes: %q", suffix, content)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if len(lines) != len(want) {
+			t.Fatalf("bot.log%s = %q, want %v", suffix, content, want)
+		}
+		for i, line := range lines {
+			if len(line) != 39 || !strings.HasPrefix(line, want[i]) {
+				t.Errorf("bot.log%s line %d = %q, want %s", suffix, i, line, want[i])
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("bot.log.3 exists beyond the 2 backups: %v", err)
+	}
+}
+
+func TestStartBotDeadlineNotifies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, searchResponse(r.URL.Query().Get("departure_date")))
+	}))
+	defer server.Close()
+
+	botConfig := testBotConfig(server.URL, "2030-01-01")
+	botConfig.Once = false
+	botConfig.Deadline = time.Now().Add(200 * time.Millisecond)
+	var stopErrors []error
+	exitCode := startBot(
+		context.Background(), botConfig,
+		func(avialableFlights AvialableFlights) error { return nil },
+		nil,
+		func(err error) error { stopErrors = append(stopErrors, err); return nil },
+	)
+	if exitCode != ExitCodeFlightsFound {
+		t.Errorf("exit code = %d, want %d", exitCode, ExitCodeFlightsFound)
+	}
+	if len(stopErrors) != 1 || !strings.Contains(stopErrors[0].Error(), "Deadline reached") {
+		t.Errorf("notified errors = %v, want the deadline stop", stopErrors)
+	}
+}